@@ -0,0 +1,382 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+// defaultBlockSize is the size of the blocks a file is sent in, unless the server limits it to something smaller.
+const defaultBlockSize = 32 * 1024 * 1024
+
+// TLS options, shared by all the commands that connect to the server.
+var (
+	tlsInsecure   bool
+	tlsCACert     string
+	tlsPinnedCert string
+)
+
+// connectToServer opens the websocket connection to serverAddress.
+func connectToServer() (*websocket.Conn, error) {
+	// Websocket connection defaults to wss, but can be overridden. Useful for local testing.
+	wsScheme := os.Getenv("MC_WS_SCHEME")
+	if wsScheme == "" {
+		wsScheme = "wss"
+	}
+
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{Scheme: wsScheme, Host: serverAddress, Path: "/ws"}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	c, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		log.Errorf("Unable to connect to %s: %s", u.String(), err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// clientTLSConfig returns the TLS configuration for connecting to the server. The server's certificate
+// is verified against the system CAs, or against the CAs in --ca-cert. With --pin-cert the certificate
+// must instead have the given SHA-256 fingerprint, which allows a self signed certificate to be trusted.
+// --insecure turns off verification, and is only meant for local testing.
+func clientTLSConfig() (*tls.Config, error) {
+	if tlsInsecure {
+		log.Warnf("Not verifying the server's certificate (--insecure)")
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tlsCACert != "" {
+		pem, err := os.ReadFile(tlsCACert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", tlsCACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if tlsPinnedCert != "" {
+		pinned := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(tlsPinnedCert, "sha256:"), ":", ""))
+
+		// The fingerprint check replaces the usual verification, which would reject a self signed certificate.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server did not send a certificate")
+			}
+
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(fingerprint[:]) != pinned {
+				return fmt.Errorf("server certificate fingerprint %x does not match the pinned fingerprint", fingerprint)
+			}
+
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// mustConnectToServer is connectToServer, but exits if the connection fails.
+func mustConnectToServer() *websocket.Conn {
+	c, err := connectToServer()
+	if err != nil {
+		log.Fatalf("Unable to connect to %s", serverAddress)
+	}
+
+	return c
+}
+
+// readResponse reads the response to a request that returns data. The server first sends a StatusResponse,
+// and if that isn't an error then the data follows.
+func readResponse(c *websocket.Conn, resp interface{}) error {
+	var status protocol.StatusResponse
+	if err := c.ReadJSON(&status); err != nil {
+		return err
+	}
+
+	if err := status.Err(); err != nil {
+		return err
+	}
+
+	return c.ReadJSON(resp)
+}
+
+// readFinalStatus reads the StatusResponse the server sends once it has finished processing a request.
+func readFinalStatus(c *websocket.Conn) error {
+	var status protocol.StatusResponse
+	if err := c.ReadJSON(&status); err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+// authenticate authenticates the session with the user's API key, for the project being worked on. The
+// server identifies the user and project in its response.
+func authenticate(c *websocket.Conn, key string) (*protocol.AuthenticateResponse, error) {
+	return sendAuthenticate(c, protocol.AuthenticateRequest{APIToken: key, ProjectID: projectID})
+}
+
+func sendAuthenticate(c *websocket.Conn, auth protocol.AuthenticateRequest) (*protocol.AuthenticateResponse, error) {
+	req := protocol.IncomingRequestType{RequestType: protocol.AuthenticateReq}
+	if err := c.WriteJSON(req); err != nil {
+		return nil, err
+	}
+
+	auth.Version = protocol.NewVersion(protocol.CurrentVersion)
+	if err := c.WriteJSON(auth); err != nil {
+		return nil, err
+	}
+
+	var authResp protocol.AuthenticateResponse
+	if err := readResponse(c, &authResp); err != nil {
+		return nil, err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return nil, err
+	}
+
+	return &authResp, nil
+}
+
+// isAuthError returns true if err means the user can't work on the project, so retrying won't help.
+func isAuthError(err error) bool {
+	code := protocol.ErrorCodeOf(err)
+	return code == protocol.ErrorCodeNotAuthenticated || code == protocol.ErrorCodeNoProjectAccess
+}
+
+// getServerInfo asks the server for its limits and the features it supports.
+func getServerInfo(c *websocket.Conn) (*protocol.ServerInfoResponse, error) {
+	req := protocol.IncomingRequestType{RequestType: protocol.ServerInfoReq}
+	if err := c.WriteJSON(req); err != nil {
+		return nil, err
+	}
+
+	if err := c.WriteJSON(protocol.ServerInfoRequest{}); err != nil {
+		return nil, err
+	}
+
+	var serverInfo protocol.ServerInfoResponse
+	if err := readResponse(c, &serverInfo); err != nil {
+		return nil, err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return nil, err
+	}
+
+	return &serverInfo, nil
+}
+
+// uploadBlockSize returns the block size to upload with, which is the default unless the server
+// only accepts smaller blocks.
+func uploadBlockSize(serverInfo *protocol.ServerInfoResponse) int64 {
+	if serverInfo.MaxBlockSize > 0 && serverInfo.MaxBlockSize < defaultBlockSize {
+		return serverInfo.MaxBlockSize
+	}
+
+	return defaultBlockSize
+}
+
+// chooseChecksumAlgorithm returns the checksum algorithm to upload with. If requested is empty then it is
+// the first algorithm the server lists, which the server lists in order of preference, that the client
+// also supports. Otherwise the requested algorithm is used, as long as the server supports it.
+func chooseChecksumAlgorithm(serverInfo *protocol.ServerInfoResponse, requested string) (ft.ChecksumAlgorithm, error) {
+	if requested != "" {
+		if !serverSupportsChecksum(serverInfo, requested) {
+			return ft.ChecksumAlgorithm{}, fmt.Errorf("server does not support %s checksums", requested)
+		}
+		return ft.LookupChecksumAlgorithm(requested)
+	}
+
+	if len(serverInfo.ChecksumAlgorithms) == 0 {
+		// Servers from before there was a choice of algorithms only support the default.
+		return ft.LookupChecksumAlgorithm(ft.DefaultChecksumAlgorithm)
+	}
+
+	for _, name := range serverInfo.ChecksumAlgorithms {
+		if name == "" {
+			continue
+		}
+		if algorithm, err := ft.LookupChecksumAlgorithm(name); err == nil {
+			return algorithm, nil
+		}
+	}
+
+	return ft.ChecksumAlgorithm{}, fmt.Errorf("server supports none of the checksum algorithms %s",
+		strings.Join(ft.ChecksumAlgorithmNames(), ", "))
+}
+
+func serverSupportsChecksum(serverInfo *protocol.ServerInfoResponse, algorithm string) bool {
+	if len(serverInfo.ChecksumAlgorithms) == 0 {
+		return algorithm == ft.DefaultChecksumAlgorithm
+	}
+
+	for _, a := range serverInfo.ChecksumAlgorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sessionTokenRenewBefore is how long before a session token expires that a new one is created, so that a
+// connection isn't authenticated with a token that is about to expire.
+const sessionTokenRenewBefore = 5 * time.Minute
+
+// credentials are what the connections of a command authenticate with. The API key is only sent until a
+// session token has been created, after which connections authenticate with the session token. That way
+// the long-lived API key isn't sent on every connection. The session token is restricted to writing under
+// pathPrefix, when it is set, so that a leaked token can only be used to write where the command would have.
+type credentials struct {
+	apiKey     string
+	pathPrefix string
+
+	mu           sync.Mutex
+	sessionToken string
+	expiresAt    time.Time
+}
+
+func newCredentials(apiKey, pathPrefix string) *credentials {
+	return &credentials{apiKey: apiKey, pathPrefix: pathPrefix}
+}
+
+// authenticate authenticates c with the session token if there is one, otherwise with the API key. It
+// returns true if c was authenticated with the session token. If the server no longer accepts the session
+// token it is forgotten, so the next connection uses the API key.
+func (cr *credentials) authenticate(c *websocket.Conn) (bool, error) {
+	auth := protocol.AuthenticateRequest{ProjectID: projectID}
+
+	cr.mu.Lock()
+	if cr.sessionToken != "" && time.Now().Add(sessionTokenRenewBefore).Before(cr.expiresAt) {
+		auth.SessionToken = cr.sessionToken
+	} else {
+		auth.APIToken = cr.apiKey
+	}
+	cr.mu.Unlock()
+
+	_, err := sendAuthenticate(c, auth)
+	if auth.SessionToken != "" && protocol.ErrorCodeOf(err) == protocol.ErrorCodeInvalidSessionToken {
+		cr.mu.Lock()
+		if cr.sessionToken == auth.SessionToken {
+			cr.sessionToken = ""
+		}
+		cr.mu.Unlock()
+	}
+
+	return auth.SessionToken != "", err
+}
+
+// createSessionTokenIfNeeded creates a session token over c, if the server supports them and there isn't a
+// usable one already. c must have been authenticated with the API key.
+func (cr *credentials) createSessionTokenIfNeeded(c *websocket.Conn, serverInfo *protocol.ServerInfoResponse) error {
+	if !serverInfo.SessionTokensSupported {
+		return nil
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.sessionToken != "" && time.Now().Add(sessionTokenRenewBefore).Before(cr.expiresAt) {
+		return nil
+	}
+
+	req := protocol.IncomingRequestType{RequestType: protocol.CreateSessionTokenReq}
+	if err := c.WriteJSON(req); err != nil {
+		return err
+	}
+
+	if err := c.WriteJSON(protocol.CreateSessionTokenRequest{PathPrefix: cr.pathPrefix}); err != nil {
+		return err
+	}
+
+	var resp protocol.SessionTokenResponse
+	if err := readResponse(c, &resp); err != nil {
+		return err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return err
+	}
+
+	cr.sessionToken = resp.SessionToken
+	cr.expiresAt = resp.ExpiresAt
+
+	return nil
+}
+
+// revokeSessionToken revokes the session token, if one was created, so that it can't be used once the
+// command is done with it.
+func (cr *credentials) revokeSessionToken() {
+	cr.mu.Lock()
+	token := cr.sessionToken
+	cr.mu.Unlock()
+
+	if token == "" {
+		return
+	}
+
+	c, err := connectToServer()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	if usedSessionToken, err := cr.authenticate(c); err != nil || !usedSessionToken {
+		return
+	}
+
+	req := protocol.IncomingRequestType{RequestType: protocol.RevokeSessionTokenReq}
+	if err := c.WriteJSON(req); err != nil {
+		return
+	}
+
+	if err := c.WriteJSON(protocol.RevokeSessionTokenRequest{}); err != nil {
+		return
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		log.Errorf("Unable to revoke session token: %s", err)
+	}
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+func TestChooseChecksumAlgorithm(t *testing.T) {
+	tests := []struct {
+		name       string
+		algorithms []string
+		requested  string
+		want       string
+		wantErr    bool
+	}{
+		{name: "old server", algorithms: nil, want: "md5"},
+		{name: "server preference", algorithms: []string{"md5", "sha256"}, want: "md5"},
+		{name: "server prefers another", algorithms: []string{"sha256", "md5"}, want: "sha256"},
+		{name: "skips unknown", algorithms: []string{"", "whirlpool", "blake3"}, want: "blake3"},
+		{name: "none known", algorithms: []string{"whirlpool"}, wantErr: true},
+		{name: "requested", algorithms: []string{"md5", "sha256"}, requested: "sha256", want: "sha256"},
+		{name: "requested unsupported by server", algorithms: []string{"md5"}, requested: "sha256", wantErr: true},
+		{name: "requested from old server", algorithms: nil, requested: "md5", want: "md5"},
+		{name: "requested non-md5 from old server", algorithms: nil, requested: "sha256", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverInfo := &protocol.ServerInfoResponse{ChecksumAlgorithms: test.algorithms}
+			algorithm, err := chooseChecksumAlgorithm(serverInfo, test.requested)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("chooseChecksumAlgorithm = %s, want an error", algorithm.Name)
+				}
+				return
+			}
+
+			if err != nil || algorithm.Name != test.want {
+				t.Fatalf("chooseChecksumAlgorithm = %s, %v, want %s", algorithm.Name, err, test.want)
+			}
+		})
+	}
+}
@@ -15,36 +15,210 @@
 package cmd
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/materials-commons/mcft/pkg/protocol"
 	"github.com/spf13/cobra"
 )
 
+var (
+	downloadTo        string
+	downloadRecursive bool
+)
+
 // downloadCmd represents the download command
 var downloadCmd = &cobra.Command{
-	Use:   "download",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Use:     "download <project-files-or-directories>",
+	Aliases: []string{"down"},
+	Short:   "Download files/directories from Materials Commons",
+	Long: `Download files/directories from a Materials Commons project. Paths are relative to the
+root of the project. Directories are only downloaded when --recursive is given, in which case
+the project directory tree is recreated under the download directory.`,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("download called")
+		if projectID < 1 {
+			log.Fatalf("You must specify a project id to download from")
+		}
+
+		apiKey := mustReadApiKey()
+		c := mustConnectToServer()
+		defer c.Close()
+
+		if _, err := authenticate(c, apiKey); err != nil {
+			log.Fatalf("Unable to authenticate: %s", err)
+		}
+
+		for _, projectPath := range args {
+			projectPath = path.Join("/", projectPath)
+			localPath := downloadTo
+			if projectPath != "/" {
+				localPath = filepath.Join(downloadTo, path.Base(projectPath))
+			}
+
+			if err := downloadPath(c, projectPath, localPath); err != nil {
+				log.Errorf("Download failed for %s: %s", projectPath, err)
+			}
+		}
 	},
 }
 
-func init() {
-	rootCmd.AddCommand(downloadCmd)
+// downloadPath downloads projectPath to localPath. If projectPath is a directory then each of its
+// entries is downloaded into localPath, recursing into sub directories.
+func downloadPath(c *websocket.Conn, projectPath, localPath string) error {
+	incomingReq := protocol.IncomingRequestType{RequestType: protocol.DownloadReq}
+	if err := c.WriteJSON(incomingReq); err != nil {
+		return err
+	}
+
+	downloadReq := protocol.DownloadRequest{
+		Path:    projectPath,
+		Version: protocol.NewVersion(protocol.CurrentVersion),
+	}
+	if err := c.WriteJSON(downloadReq); err != nil {
+		return err
+	}
+
+	var fileInfo protocol.FileInfo
+	if err := readResponse(c, &fileInfo); err != nil {
+		return err
+	}
+
+	if !fileInfo.IsDir {
+		return downloadFile(c, projectPath, localPath, fileInfo)
+	}
+
+	var listing protocol.ListDirectoryResponse
+	if err := c.ReadJSON(&listing); err != nil {
+		return err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return err
+	}
+
+	if !downloadRecursive {
+		return fmt.Errorf("%s is a directory, use --recursive to download directories", projectPath)
+	}
+
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+
+	for _, entry := range listing.Files {
+		if !isPlainName(entry.Name) {
+			log.Errorf("Skipping entry %q in %s, it isn't a valid file name", entry.Name, projectPath)
+			continue
+		}
+
+		if !entry.UploadComplete {
+			// An interrupted upload, there is nothing to download yet.
+			continue
+		}
+
+		entryProjectPath := path.Join(projectPath, entry.Name)
+		entryLocalPath := filepath.Join(localPath, entry.Name)
+		if err := downloadPath(c, entryProjectPath, entryLocalPath); err != nil {
+			log.Errorf("Download failed for %s: %s", entryProjectPath, err)
+		}
+	}
+
+	return nil
+}
 
-	// Here you will define your flags and configuration settings.
+// isPlainName returns true if name, which comes from the server, is a single file or directory name that
+// can't take a download outside of the directory it is joined to.
+func isPlainName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// downloadCmd.PersistentFlags().String("foo", "", "A help for foo")
+	return !strings.ContainsAny(name, `/\`) && filepath.Base(name) == name && filepath.VolumeName(name) == ""
+}
+
+// downloadFile reads the blocks for a file from the server, writing them to localPath. Once all the blocks
+// have been read the checksum is compared against the one the server has for the file. On a mismatch the
+// local file is removed.
+func downloadFile(c *websocket.Conn, projectPath, localPath string, fileInfo protocol.FileInfo) error {
+	fmt.Printf("Downloading file: %s to %s\n\n", projectPath, localPath)
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	algorithm, err := ft.LookupChecksumAlgorithm(fileInfo.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	hasher := algorithm.New()
+	if err := readFileBlocks(c, f, hasher, fileInfo.Size); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return err
+	}
+
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if fileInfo.Checksum != "" && checksum != fileInfo.Checksum {
+		_ = os.Remove(localPath)
+		return fmt.Errorf("checksums didn't match got (%s), expected (%s)", checksum, fileInfo.Checksum)
+	}
+
+	return nil
+}
+
+func readFileBlocks(c *websocket.Conn, f *os.File, hasher hash.Hash, size int64) error {
+	var (
+		fb       protocol.FileBlockRequest
+		buf      bytes.Buffer
+		received int64
+	)
+
+	for received < size {
+		if err := protocol.ReadFileBlock(c, &fb, &buf, 0); err != nil {
+			return err
+		}
+
+		if len(fb.Block) == 0 {
+			return errors.New("download ended before all of the file was received")
+		}
+
+		if _, err := f.Write(fb.Block); err != nil {
+			return err
+		}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// downloadCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+		_, _ = hasher.Write(fb.Block)
+		received += int64(len(fb.Block))
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(downloadCmd)
+	downloadCmd.PersistentFlags().StringVarP(&downloadTo, "download-to", "o", ".", "Local directory to download to")
+	downloadCmd.PersistentFlags().BoolVarP(&downloadRecursive, "recursive", "r", false, "Download directories recursively")
+	downloadCmd.PersistentFlags().IntVarP(&projectID, "project-id", "p", -1, "Project ID to download from")
+	downloadCmd.PersistentFlags().StringVarP(&serverAddress, "server-address", "s", "materialscommons.org", "Server to connect to")
 }
@@ -0,0 +1,160 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/materials-commons/mcft/pkg/protocol"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lsRecursive bool
+	lsJSON      bool
+)
+
+// lsEntry is a file or directory in a listing, along with its path in the project.
+type lsEntry struct {
+	Path string `json:"path"`
+	protocol.FileInfo
+}
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls [-r] [project-path]",
+	Short: "List files/directories in a Materials Commons project",
+	Long: `List the files and directories in a Materials Commons project directory, or show a single file.
+The path is relative to the root of the project, and defaults to the root. Output is a table unless
+--json is given, in which case it is a JSON array of the entries. Interrupted uploads that haven't
+been finished are listed as partial, with the size the server has so far.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if projectID < 1 {
+			log.Fatalf("You must specify a project id to list")
+		}
+
+		projectPath := "/"
+		if len(args) == 1 {
+			projectPath = path.Join("/", args[0])
+		}
+
+		apiKey := mustReadApiKey()
+		c := mustConnectToServer()
+		defer c.Close()
+
+		if _, err := authenticate(c, apiKey); err != nil {
+			log.Fatalf("Unable to authenticate: %s", err)
+		}
+
+		entries, err := listPath(c, projectPath, lsRecursive)
+		if err != nil {
+			log.Fatalf("Unable to list %s: %s", projectPath, err)
+		}
+
+		if lsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(entries); err != nil {
+				log.Fatalf("Unable to write listing: %s", err)
+			}
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tSIZE\tUPDATED\tCHECKSUM\tSTATUS")
+		for _, entry := range entries {
+			name := entry.Path
+			if entry.IsDir {
+				name += "/"
+			}
+			status := ""
+			if !entry.UploadComplete {
+				status = "partial"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", name, entry.Size, entry.UpdatedAt.Local().Format("2006-01-02 15:04"), entry.Checksum, status)
+		}
+		_ = w.Flush()
+	},
+}
+
+// listPath lists projectPath. If recursive is true then the entries of sub directories are listed after
+// the directory they are in.
+func listPath(c *websocket.Conn, projectPath string, recursive bool) ([]lsEntry, error) {
+	listing, err := listDirectory(c, projectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []lsEntry
+	for _, fileInfo := range listing.Files {
+		entryPath := listing.Path
+		if listing.IsDir {
+			entryPath = path.Join(listing.Path, fileInfo.Name)
+		}
+
+		entries = append(entries, lsEntry{Path: entryPath, FileInfo: fileInfo})
+		if recursive && fileInfo.IsDir {
+			subEntries, err := listPath(c, entryPath, recursive)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, subEntries...)
+		}
+	}
+
+	return entries, nil
+}
+
+// listDirectory asks the server for the entries in the directory projectPath.
+func listDirectory(c *websocket.Conn, projectPath string) (*protocol.ListDirectoryResponse, error) {
+	req := protocol.IncomingRequestType{RequestType: protocol.ListDirectoryReq}
+	if err := c.WriteJSON(req); err != nil {
+		return nil, err
+	}
+
+	listReq := protocol.ListDirectoryRequest{
+		Path:    projectPath,
+		Version: protocol.NewVersion(protocol.CurrentVersion),
+	}
+	if err := c.WriteJSON(listReq); err != nil {
+		return nil, err
+	}
+
+	var listing protocol.ListDirectoryResponse
+	if err := readResponse(c, &listing); err != nil {
+		return nil, err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return nil, err
+	}
+
+	return &listing, nil
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+	lsCmd.PersistentFlags().BoolVarP(&lsRecursive, "recursive", "r", false, "List directories recursively")
+	lsCmd.PersistentFlags().BoolVar(&lsJSON, "json", false, "Output the listing as JSON")
+	lsCmd.PersistentFlags().IntVarP(&projectID, "project-id", "p", -1, "Project ID to list")
+	lsCmd.PersistentFlags().StringVarP(&serverAddress, "server-address", "s", "materialscommons.org", "Server to connect to")
+}
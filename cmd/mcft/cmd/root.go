@@ -49,6 +49,9 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.mcft.yaml)")
+	rootCmd.PersistentFlags().StringVar(&tlsCACert, "ca-cert", "", "PEM file of CA certificates to verify the server's certificate with")
+	rootCmd.PersistentFlags().StringVar(&tlsPinnedCert, "pin-cert", "", "SHA-256 fingerprint the server's certificate must have")
+	rootCmd.PersistentFlags().BoolVar(&tlsInsecure, "insecure", false, "Don't verify the server's certificate (for local testing only)")
 }
 
 // initConfig reads in config file and ENV variables if set.
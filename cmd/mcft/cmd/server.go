@@ -15,13 +15,9 @@
 package cmd
 
 import (
-	"crypto/tls"
-	"net/url"
-	"os"
 	"time"
 
 	"github.com/apex/log"
-	"github.com/gorilla/websocket"
 	"github.com/materials-commons/mcft/pkg/protocol"
 	"github.com/spf13/cobra"
 )
@@ -33,22 +29,11 @@ var serverCmd = &cobra.Command{
 	Long:  `Connect to remote Materials Commons server for uploads.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		apiKey := mustReadApiKey()
-		// Websocket connection defaults to wss, but can be overridden. Useful for local testing.
-		wsScheme := os.Getenv("MC_WS_SCHEME")
-		if wsScheme == "" {
-			wsScheme = "wss"
-		}
-
-		u := url.URL{Scheme: wsScheme, Host: serverAddress, Path: "/ws"}
-		websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-		if err != nil {
-			log.Fatalf("Unable to connect to %s: %s", u.String(), err)
-		}
+		c := mustConnectToServer()
 		defer c.Close()
 
-		if !authenticate(c, apiKey) {
-			log.Fatalf("Unable to authenticate")
+		if _, err := authenticate(c, apiKey); err != nil {
+			log.Fatalf("Unable to authenticate: %s", err)
 		}
 
 		var reqType protocol.IncomingRequestType
@@ -15,39 +15,64 @@
 package cmd
 
 import (
-	"bytes"
-	"crypto/md5"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apex/log"
-	"github.com/gorilla/websocket"
-	"github.com/materials-commons/mcft/pkg/protocol"
+	"github.com/materials-commons/mcft/pkg/ft"
 	"github.com/saracen/walker"
 	"github.com/spf13/cobra"
 )
 
 var (
-	uploadTo      string
-	serverAddress string
-	projectID     int
+	uploadTo       string
+	serverAddress  string
+	projectID      int
+	uploadRetries  int
+	uploadParallel int
+	uploadChecksum string
+	uploadSync     bool
+	uploadDryRun   bool
+
+	// uploadOfferChecksum, when set, offers the checksum of each new file to the server before sending
+	// it, which costs an extra read of the file.
+	uploadOfferChecksum bool
+
+	// uploadPauseAfter, when set, pauses the upload after it has been running for that long.
+	uploadPauseAfter time.Duration
 )
 
+// errUploadPaused is returned when an upload was paused rather than finished.
+var errUploadPaused = errors.New("upload paused")
+
+// pauseRequested is set when the user has asked for uploads to be paused, either by interrupting
+// the upload or because --pause-after expired. It is accessed atomically.
+var pauseRequested int32
+
 // uploadCmd represents the upload command
 var uploadCmd = &cobra.Command{
 	Use:     "upload <files-or-directories>",
 	Aliases: []string{"up"},
 	Short:   "Upload files/directories to Materials Commons",
-	Long:    `Upload files/directories to Materials Commons`,
-	Args:    cobra.MinimumNArgs(1),
+	Long: `Upload files/directories to Materials Commons. Interrupting an upload (Ctrl-C) pauses
+the file being uploaded on the server. Running the same command again resumes it.
+
+With --sync files that are already in the project with the same size and checksum are skipped.
+Use --dry-run to list the files that would be uploaded without uploading them.
+
+Before a new file is sent its checksum is offered to the server, so that contents the project already
+has aren't sent again. This reads the file an extra time, which for large files that are unlikely to be
+in the project can be turned off with --offer-checksum=false.`,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
 		if uploadTo == "" {
@@ -58,9 +83,40 @@ var uploadCmd = &cobra.Command{
 			log.Fatalf("You must specify a project id to upload to")
 		}
 
-		apiKey := mustReadApiKey()
+		if uploadParallel < 1 {
+			log.Fatalf("--parallel must be at least 1")
+		}
+
+		if uploadChecksum != "" {
+			if _, err := ft.LookupChecksumAlgorithm(uploadChecksum); err != nil {
+				log.Fatalf("%s, supported algorithms are %s", err, strings.Join(ft.ChecksumAlgorithmNames(), ", "))
+			}
+		}
+
+		creds := newCredentials(mustReadApiKey(), uploadTo)
+		handlePauseRequests()
+
+		// Files are queued up as they are found and handed out to uploadParallel sessions, each of which
+		// uploads its files one after another. Each session has its own block buffer, so memory use is
+		// bounded by the number of sessions.
+		var (
+			jobs     = make(chan uploadJob)
+			failures uploadFailures
+			wg       sync.WaitGroup
+		)
+		for i := 0; i < uploadParallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				newUploadSession(creds, &failures, uploadChecksum).uploadFiles(jobs)
+			}()
+		}
 
 		for _, fileOrDirPath := range args {
+			if pauseIsRequested() {
+				break
+			}
+
 			basePath, _ := filepath.Abs(fileOrDirPath)
 			basePath = filepath.Dir(basePath)
 			fi, err := os.Stat(fileOrDirPath)
@@ -76,15 +132,17 @@ var uploadCmd = &cobra.Command{
 						return nil
 					}
 
+					if pauseIsRequested() {
+						// halt traversal, there is nothing more to upload
+						return errUploadPaused
+					}
+
 					if !strings.HasPrefix(pathname, "/") {
 						pathname, _ = filepath.Abs(pathname)
 					}
 					pathname = filepath.Clean(pathname)
 					uploadPath := filepath.Join("/", strings.Replace(pathname, basePath, uploadTo, 1))
-					fmt.Printf("Uploading file: %s to %s\n\n", pathname, uploadPath)
-					if err := uploadFile(pathname, uploadPath, apiKey); err != nil {
-						log.Errorf("Upload failed for %s: %s", pathname, err)
-					}
+					jobs <- uploadJob{pathToFile: pathname, uploadToPath: uploadPath}
 
 					return nil
 				}
@@ -118,157 +176,48 @@ var uploadCmd = &cobra.Command{
 				}
 
 				fileOrDirPath = filepath.Clean(fileOrDirPath)
-				fmt.Printf("Uploading file: %s to %s\n\n", fileOrDirPath, uploadPath)
-				if err := uploadFile(fileOrDirPath, uploadPath, apiKey); err != nil {
-					log.Errorf("Upload failed for %s: %s", fileOrDirPath, err)
-				}
+				jobs <- uploadJob{pathToFile: fileOrDirPath, uploadToPath: uploadPath}
 			}
 		}
-	},
-}
-
-func uploadFile(pathToFile, uploadToPath, apiKey string) error {
-	// Websocket connection defaults to wss, but can be overridden. Useful for local testing.
-	wsScheme := os.Getenv("MC_WS_SCHEME")
-	if wsScheme == "" {
-		wsScheme = "wss"
-	}
-
-	u := url.URL{Scheme: wsScheme, Host: serverAddress, Path: "/ws"}
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatalf("Unable to connect to %s: %s", u.String(), err)
-	}
-	defer c.Close()
-
-	f, err := os.Open(pathToFile)
-
-	if err != nil {
-		log.Fatalf("Unable to open %s: %s", pathToFile, err)
-	}
-	defer f.Close()
-
-	var incomingReq protocol.IncomingRequestType
-
-	if !authenticate(c, apiKey) {
-		log.Fatalf("Unable to authenticate")
-	}
-
-	incomingReq.RequestType = protocol.UploadFileReq
-	if err := c.WriteJSON(incomingReq); err != nil {
-		//log.Errorf("Unable to initiate upload: %s", err)
-		return err
-	}
 
-	// First send notice of upload
-	uploadMsg := protocol.UploadFileRequest{
-		Path: uploadToPath,
-	}
+		close(jobs)
+		wg.Wait()
+		creds.revokeSessionToken()
 
-	if err := c.WriteJSON(uploadMsg); err != nil {
-		//log.Errorf("Unable to initiate upload: %s", err)
-		return err
-	}
-
-	var status protocol.StatusResponse
-	if err := c.ReadJSON(&status); err != nil {
-		log.Errorf("Unable to read upload status: %s", err)
-		return err
-	}
-
-	if status.IsError {
-		log.Errorf("Error starting file transfer: %s", status.Status)
-		return errors.New("failed to start transfer")
-	}
-
-	data := make([]byte, 32*1024*1024)
-	fb := protocol.FileBlockRequest{}
-	hasher := md5.New()
-	for {
-
-		n, err := f.Read(data)
-		if err != nil {
-			if err != io.EOF {
-				//log.Errorf("Read returned error: %s", err)
-				return err
-			}
-			break
+		if pauseIsRequested() {
+			fmt.Println("Upload paused, run the same command again to resume it.")
 		}
 
-		incomingReq.RequestType = protocol.FileBlockReq
-		if err := c.WriteJSON(incomingReq); err != nil {
-			log.Errorf("Error during upload: %s", err)
-			return err
+		if failures.report() {
+			os.Exit(1)
 		}
-
-		fb.Block = data[:n]
-		if err := c.WriteJSON(fb); err != nil {
-			//log.Errorf("WriteJSON failed: %s", err)
-			return err
-		}
-
-		_, _ = io.Copy(hasher, bytes.NewBuffer(data[:n]))
-
-		var status protocol.StatusResponse
-		if err := c.ReadJSON(&status); err != nil {
-			log.Errorf("Unable to read upload status: %s", err)
-			return err
-		}
-
-		if status.IsError {
-			log.Errorf("Error uploading file: %s", status.Status)
-			return errors.New("failed upload")
-		}
-	}
-
-	// compute checksum and check that they match by sending to the server
-	var finishUploadRequest protocol.FinishUploadRequest
-	finishUploadRequest.FileChecksum = fmt.Sprintf("%x", hasher.Sum(nil))
-	finishUploadRequest.Path = uploadToPath
-	incomingReq.RequestType = protocol.FinishUploadReq
-
-	if err := c.WriteJSON(incomingReq); err != nil {
-		log.Errorf("Error during upload: %s", err)
-		return err
-	}
-
-	if err := c.WriteJSON(&finishUploadRequest); err != nil {
-		log.Errorf("Error during upload: %s", err)
-		return err
-	}
-
-	if err := c.ReadJSON(&status); err != nil {
-		log.Errorf("Unable to read upload status: %s", err)
-		return err
-	}
-
-	// Uh oh the checksums didn't match
-	if status.IsError {
-		log.Errorf("Error uploading file: %s", status.Status)
-		return errors.New("failed upload - checksums didn't match")
-	}
-
-	return nil
+	},
 }
 
-func authenticate(c *websocket.Conn, key string) bool {
-	var req protocol.IncomingRequestType
-	req.RequestType = protocol.AuthenticateReq
-	if err := c.WriteJSON(req); err != nil {
-		return false
-	}
-
-	auth := protocol.AuthenticateRequest{
-		APIToken:  key,
-		ProjectID: projectID,
-	}
-
-	if err := c.WriteJSON(auth); err != nil {
-		return false
+// handlePauseRequests arranges for an interrupt (SIGINT), or the --pause-after timer if it was given, to
+// pause uploads. The upload in progress is paused on the server after its current block is sent. A second
+// interrupt exits immediately.
+func handlePauseRequests() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		fmt.Println("Pausing upload, interrupt again to exit immediately...")
+		atomic.StoreInt32(&pauseRequested, 1)
+		<-sigs
+		os.Exit(1)
+	}()
+
+	if uploadPauseAfter > 0 {
+		time.AfterFunc(uploadPauseAfter, func() {
+			fmt.Printf("Pausing upload after %s...\n", uploadPauseAfter)
+			atomic.StoreInt32(&pauseRequested, 1)
+		})
 	}
+}
 
-	return true
+func pauseIsRequested() bool {
+	return atomic.LoadInt32(&pauseRequested) == 1
 }
 
 func mustReadApiKey() string {
@@ -303,4 +252,11 @@ func init() {
 	uploadCmd.PersistentFlags().StringVarP(&uploadTo, "upload-to", "t", "", "Path to upload to in project")
 	uploadCmd.PersistentFlags().IntVarP(&projectID, "project-id", "p", -1, "Project ID to upload to")
 	uploadCmd.PersistentFlags().StringVarP(&serverAddress, "server-address", "s", "materialscommons.org", "Server to connect to")
+	uploadCmd.PersistentFlags().IntVar(&uploadRetries, "retries", 3, "Number of times to retry a failed upload. Interrupted uploads resume, uploads that fail their checksum start over")
+	uploadCmd.PersistentFlags().StringVar(&uploadChecksum, "checksum", "", "Checksum algorithm to verify uploads with ("+strings.Join(ft.ChecksumAlgorithmNames(), ", ")+"), default the one the server prefers")
+	uploadCmd.PersistentFlags().IntVar(&uploadParallel, "parallel", 1, "Number of files to upload at the same time")
+	uploadCmd.PersistentFlags().BoolVar(&uploadSync, "sync", false, "Only upload files that aren't already in the project with the same contents")
+	uploadCmd.PersistentFlags().BoolVar(&uploadDryRun, "dry-run", false, "List the files that would be uploaded without uploading them")
+	uploadCmd.PersistentFlags().BoolVar(&uploadOfferChecksum, "offer-checksum", true, "Offer the checksum of each new file to the server before sending it")
+	uploadCmd.PersistentFlags().DurationVar(&uploadPauseAfter, "pause-after", 0, "Pause the upload after it has been running this long (eg 2h)")
 }
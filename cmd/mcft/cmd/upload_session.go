@@ -0,0 +1,629 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+// maxBlockResends is the number of times a block that fails its checksum on the server is resent
+// before giving up on the upload.
+const maxBlockResends = 3
+
+// serverRestartWait is how long to wait before resuming an upload that was paused because the server was
+// shutting down, to give the server time to come back.
+const serverRestartWait = 15 * time.Second
+
+// errChecksumMismatch is returned when the server rejected a finished upload because the file checksum
+// didn't match. The server throws away the upload, so retrying it starts over from the beginning.
+var errChecksumMismatch = errors.New("failed upload - checksums didn't match")
+
+// errFileTooLarge is returned when a file is larger than the server accepts, in which case it isn't sent.
+var errFileTooLarge = errors.New("file is larger than the server accepts")
+
+// errUnreadableFile is returned when the local file can't be opened, for example because it was removed
+// after it was found. Nothing has been sent, so the session can go on to the next file.
+var errUnreadableFile = errors.New("unable to read local file")
+
+// uploadJob is a file to upload and the path in the project to upload it to.
+type uploadJob struct {
+	pathToFile   string
+	uploadToPath string
+}
+
+// uploadFailures collects the files that failed to upload across all the sessions, so they can be
+// reported together once the upload is done.
+type uploadFailures struct {
+	mu     sync.Mutex
+	failed []uploadFailure
+}
+
+type uploadFailure struct {
+	pathToFile string
+	err        error
+}
+
+func (f *uploadFailures) add(pathToFile string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = append(f.failed, uploadFailure{pathToFile: pathToFile, err: err})
+}
+
+// report prints the files that failed to upload. It returns true if there were any.
+func (f *uploadFailures) report() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.failed) == 0 {
+		return false
+	}
+
+	sort.Slice(f.failed, func(i, j int) bool { return f.failed[i].pathToFile < f.failed[j].pathToFile })
+	fmt.Printf("%d file(s) failed to upload:\n", len(f.failed))
+	for _, failure := range f.failed {
+		fmt.Printf("  %s: %s\n", failure.pathToFile, failure.err)
+	}
+
+	return true
+}
+
+// uploadSession is a connection to the server that files are uploaded over one after another. The
+// connection is made when the first file is uploaded, and remade if a failure closes it.
+type uploadSession struct {
+	creds      *credentials
+	c          *websocket.Conn
+	serverInfo *protocol.ServerInfoResponse
+	failures   *uploadFailures
+
+	// requestedChecksum is the checksum algorithm given with --checksum, empty to use the one the server
+	// prefers. checksumAlgorithm is the algorithm chosen when connecting, which is used to checksum files
+	// and blocks.
+	requestedChecksum string
+	checksumAlgorithm ft.ChecksumAlgorithm
+
+	// data is the buffer blocks are read into. It is sized by the block size the server accepts.
+	data []byte
+
+	// syncChecksum is the checksum isOnServer computed for the file it last compared, so that offering
+	// the file's checksum doesn't have to read the file again.
+	syncChecksum fileChecksum
+}
+
+// fileChecksum is the checksum of a local file computed with an algorithm.
+type fileChecksum struct {
+	pathToFile string
+	algorithm  string
+	checksum   string
+}
+
+func newUploadSession(creds *credentials, failures *uploadFailures, requestedChecksum string) *uploadSession {
+	return &uploadSession{creds: creds, failures: failures, requestedChecksum: requestedChecksum}
+}
+
+// uploadFiles uploads each job until jobs is closed. Once a pause has been requested the remaining
+// jobs are skipped.
+func (s *uploadSession) uploadFiles(jobs <-chan uploadJob) {
+	defer s.close()
+
+	for job := range jobs {
+		if pauseIsRequested() {
+			continue
+		}
+
+		if uploadSync {
+			identical, err := s.isOnServer(job.pathToFile, job.uploadToPath)
+			if err != nil {
+				log.Errorf("Unable to compare %s with %s on the server, uploading it: %s", job.pathToFile, job.uploadToPath, err)
+			}
+
+			if identical {
+				fmt.Printf("Skipping %s, identical to %s\n", job.pathToFile, job.uploadToPath)
+				continue
+			}
+		}
+
+		if uploadDryRun {
+			fmt.Printf("Would upload %s to %s\n", job.pathToFile, job.uploadToPath)
+			continue
+		}
+
+		fmt.Printf("Uploading file: %s to %s\n\n", job.pathToFile, job.uploadToPath)
+		if err := s.uploadFile(job.pathToFile, job.uploadToPath); err != nil && err != errUploadPaused {
+			log.Errorf("Upload failed for %s: %s", job.pathToFile, err)
+			s.failures.add(job.pathToFile, err)
+		}
+	}
+}
+
+// connect opens the connection, authenticates, and gets the server's limits. The first session to
+// authenticate with the API key creates the session token the other connections authenticate with.
+func (s *uploadSession) connect() error {
+	c, err := connectToServer()
+	if err != nil {
+		return err
+	}
+
+	usedSessionToken, err := s.creds.authenticate(c)
+	if err != nil {
+		_ = c.Close()
+		if isAuthError(err) {
+			log.Fatalf("Unable to authenticate: %s", err)
+		}
+		return err
+	}
+
+	serverInfo, err := getServerInfo(c)
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
+
+	if !usedSessionToken {
+		if err := s.creds.createSessionTokenIfNeeded(c, serverInfo); err != nil {
+			_ = c.Close()
+			return err
+		}
+	}
+
+	algorithm, err := chooseChecksumAlgorithm(serverInfo, s.requestedChecksum)
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
+	s.checksumAlgorithm = algorithm
+
+	s.c = c
+	s.serverInfo = serverInfo
+	if blockSize := uploadBlockSize(serverInfo); int64(len(s.data)) != blockSize {
+		s.data = make([]byte, blockSize)
+	}
+
+	return nil
+}
+
+func (s *uploadSession) close() {
+	if s.c != nil {
+		_ = s.c.Close()
+		s.c = nil
+	}
+}
+
+// uploadFile uploads pathToFile to uploadToPath in the project. If the upload fails it is retried up to
+// uploadRetries times. The server ends the session when a request fails, so each retry reconnects to the
+// server and resumes the upload from where the server says it left off. An upload that failed its checksum
+// has been thrown away by the server, so its retry starts over.
+func (s *uploadSession) uploadFile(pathToFile, uploadToPath string) error {
+	var err error
+	for attempt := 0; attempt <= uploadRetries; attempt++ {
+		if pauseIsRequested() {
+			return errUploadPaused
+		}
+
+		if attempt > 0 {
+			wait := time.Duration(attempt) * time.Second
+			switch {
+			case err == errChecksumMismatch:
+				log.Infof("Re-uploading %s from the start (%d of %d): %s", pathToFile, attempt, uploadRetries, err)
+			case protocol.ErrorCodeOf(err) == protocol.ErrorCodeServerShuttingDown:
+				log.Infof("Server is restarting, resuming %s in %s (%d of %d)", pathToFile, serverRestartWait, attempt, uploadRetries)
+				wait = serverRestartWait
+			default:
+				log.Infof("Retrying upload of %s (%d of %d): %s", pathToFile, attempt, uploadRetries, err)
+			}
+			time.Sleep(wait)
+		}
+
+		if s.c == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+
+		err = s.uploadFileOnce(pathToFile, uploadToPath)
+		if err == nil || err == errUploadPaused || errors.Is(err, errUnreadableFile) {
+			return err
+		}
+
+		s.close()
+
+		if retryIsPointless(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// retryIsPointless returns true for failures that will happen again however many times the upload is
+// retried, such as the file being too large for the server or the project being over its quota. An
+// operator cancelling the session is also final, since they want the upload to stop, and so is another
+// upload to the same path, which would be thrown away if this one went ahead.
+func retryIsPointless(err error) bool {
+	if errors.Is(err, errFileTooLarge) {
+		return true
+	}
+
+	switch protocol.ErrorCodeOf(err) {
+	case protocol.ErrorCodeFileTooLarge,
+		protocol.ErrorCodeQuotaExceeded,
+		protocol.ErrorCodeInvalidPath,
+		protocol.ErrorCodePathNotAllowed,
+		protocol.ErrorCodeSessionCancelled,
+		protocol.ErrorCodeUploadInProgress:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *uploadSession) uploadFileOnce(pathToFile, uploadToPath string) error {
+	c := s.c
+
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUnreadableFile, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var incomingReq protocol.IncomingRequestType
+
+	if s.serverInfo.MaxSize > 0 && fi.Size() > s.serverInfo.MaxSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d bytes", errFileTooLarge, fi.Size(), s.serverInfo.MaxSize)
+	}
+
+	// Only ask the server about an earlier interrupted upload if it keeps them around to be resumed.
+	offset, hasher := int64(0), s.checksumAlgorithm.New()
+	if s.serverInfo.UploadExpirationTime > 0 {
+		if offset, hasher, err = resumeOffset(c, f, uploadToPath, s.checksumAlgorithm); err != nil {
+			return err
+		}
+	}
+
+	if offset > 0 {
+		fmt.Printf("Resuming upload of %s at offset %d\n", pathToFile, offset)
+	}
+
+	// Before sending a new file, offer its checksum in case the project already has the contents.
+	if offset == 0 && uploadOfferChecksum && s.serverInfo.OfferChecksumSupported && s.checksumAlgorithm.Dedup {
+		checksum, err := s.checksumFile(pathToFile)
+		if err != nil {
+			return err
+		}
+
+		uploaded, err := offerChecksum(c, uploadToPath, fi.Size(), checksum, s.checksumAlgorithm)
+		if err != nil {
+			return err
+		}
+
+		if uploaded {
+			fmt.Printf("Project already has the contents of %s, created %s without sending it\n", pathToFile, uploadToPath)
+			return nil
+		}
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	incomingReq.RequestType = protocol.UploadFileReq
+	if err := c.WriteJSON(incomingReq); err != nil {
+		//log.Errorf("Unable to initiate upload: %s", err)
+		return err
+	}
+
+	// First send notice of upload
+	uploadMsg := protocol.UploadFileRequest{
+		Path:              uploadToPath,
+		Size:              fi.Size(),
+		UploadOffset:      offset,
+		ChecksumAlgorithm: s.checksumAlgorithm.Name,
+	}
+
+	if err := c.WriteJSON(uploadMsg); err != nil {
+		//log.Errorf("Unable to initiate upload: %s", err)
+		return err
+	}
+
+	var status protocol.StatusResponse
+	if err := c.ReadJSON(&status); err != nil {
+		log.Errorf("Unable to read upload status: %s", err)
+		return err
+	}
+
+	if err := status.Err(); err != nil {
+		log.Errorf("Error starting file transfer: %s", err)
+		return err
+	}
+
+	data := s.data
+	fb := protocol.FileBlockRequest{Path: uploadToPath, UploadOffset: offset}
+	if s.serverInfo.BinaryBlocks() {
+		fb.Version = protocol.NewVersion(protocol.VersionBinaryBlocks)
+	}
+	for {
+		if pauseIsRequested() {
+			if err := pauseUpload(c, uploadToPath); err != nil {
+				return err
+			}
+			fmt.Printf("Paused upload of %s at offset %d\n", pathToFile, fb.UploadOffset)
+			return errUploadPaused
+		}
+
+		n, err := f.Read(data)
+		if err != nil {
+			if err != io.EOF {
+				//log.Errorf("Read returned error: %s", err)
+				return err
+			}
+			break
+		}
+
+		fb.Block = data[:n]
+		if s.serverInfo.BlockChecksumsSupported {
+			fb.Checksum = s.checksumAlgorithm.Checksum(fb.Block)
+			fb.ChecksumAlgorithm = s.checksumAlgorithm.Name
+		}
+
+		if err := s.sendBlock(&fb); err != nil {
+			return err
+		}
+
+		_, _ = io.Copy(hasher, bytes.NewBuffer(data[:n]))
+
+		fb.UploadOffset += int64(n)
+	}
+
+	// compute checksum and check that they match by sending to the server
+	var finishUploadRequest protocol.FinishUploadRequest
+	finishUploadRequest.FileChecksum = fmt.Sprintf("%x", hasher.Sum(nil))
+	finishUploadRequest.Path = uploadToPath
+	incomingReq.RequestType = protocol.FinishUploadReq
+
+	if err := c.WriteJSON(incomingReq); err != nil {
+		log.Errorf("Error during upload: %s", err)
+		return err
+	}
+
+	if err := c.WriteJSON(&finishUploadRequest); err != nil {
+		log.Errorf("Error during upload: %s", err)
+		return err
+	}
+
+	if err := c.ReadJSON(&status); err != nil {
+		log.Errorf("Unable to read upload status: %s", err)
+		return err
+	}
+
+	if err := status.Err(); err != nil {
+		log.Errorf("Error uploading file: %s", err)
+		if protocol.ErrorCodeOf(err) == protocol.ErrorCodeChecksumMismatch {
+			return errChecksumMismatch
+		}
+		return err
+	}
+
+	return nil
+}
+
+// sendBlock sends a block to the server. If the server reports that the block was corrupted on the way,
+// which it can only detect when the block has a checksum, then the block is resent up to
+// maxBlockResends times.
+func (s *uploadSession) sendBlock(fb *protocol.FileBlockRequest) error {
+	incomingReq := protocol.IncomingRequestType{RequestType: protocol.FileBlockReq}
+	for resends := 0; ; resends++ {
+		if err := s.c.WriteJSON(incomingReq); err != nil {
+			log.Errorf("Error during upload: %s", err)
+			return err
+		}
+
+		if err := protocol.WriteFileBlock(s.c, fb); err != nil {
+			//log.Errorf("WriteJSON failed: %s", err)
+			return err
+		}
+
+		var status protocol.StatusResponse
+		if err := s.c.ReadJSON(&status); err != nil {
+			log.Errorf("Unable to read upload status: %s", err)
+			return err
+		}
+
+		if !status.IsError {
+			return nil
+		}
+
+		if status.ErrorCode == protocol.ErrorCodeBlockChecksumMismatch && resends < maxBlockResends {
+			log.Infof("Block at offset %d for %s was corrupted, resending", fb.UploadOffset, fb.Path)
+			continue
+		}
+
+		log.Errorf("Error uploading file: %s", status.Status)
+		return status.Err()
+	}
+}
+
+// isOnServer returns true if the project already has a file at uploadToPath that is identical to
+// pathToFile. The sizes are compared first, and only if they match is the local file checksummed, with the
+// algorithm the server checksummed its file with.
+func (s *uploadSession) isOnServer(pathToFile, uploadToPath string) (bool, error) {
+	if s.c == nil {
+		if err := s.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	listing, err := listDirectory(s.c, uploadToPath)
+	switch {
+	case protocol.ErrorCodeOf(err) == protocol.ErrorCodeNotFound:
+		return false, nil
+	case err != nil:
+		s.close()
+		return false, err
+	case listing.IsDir || len(listing.Files) != 1:
+		return false, nil
+	}
+
+	remote := listing.Files[0]
+	fi, err := os.Stat(pathToFile)
+	if err != nil {
+		return false, err
+	}
+
+	if fi.Size() != remote.Size || remote.Checksum == "" {
+		return false, nil
+	}
+
+	algorithm, err := ft.LookupChecksumAlgorithm(remote.ChecksumAlgorithm)
+	if err != nil {
+		return false, err
+	}
+
+	checksum, err := checksumFile(pathToFile, algorithm)
+	if err != nil {
+		return false, err
+	}
+	s.syncChecksum = fileChecksum{pathToFile: pathToFile, algorithm: algorithm.Name, checksum: checksum}
+
+	return checksum == remote.Checksum, nil
+}
+
+// checksumFile returns the checksum of pathToFile with the session's algorithm, reusing the checksum
+// isOnServer computed if it used the same algorithm.
+func (s *uploadSession) checksumFile(pathToFile string) (string, error) {
+	known := s.syncChecksum
+	if known.pathToFile == pathToFile && known.algorithm == s.checksumAlgorithm.Name {
+		return known.checksum, nil
+	}
+
+	return checksumFile(pathToFile, s.checksumAlgorithm)
+}
+
+// checksumFile returns the checksum of the contents of pathToFile.
+func checksumFile(pathToFile string, algorithm ft.ChecksumAlgorithm) (string, error) {
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := algorithm.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// offerChecksum sends the checksum of the file to the server. It returns true if the server created the
+// file at uploadToPath from contents it already has, in which case there is nothing to upload.
+func offerChecksum(c *websocket.Conn, uploadToPath string, size int64, checksum string, algorithm ft.ChecksumAlgorithm) (bool, error) {
+	req := protocol.IncomingRequestType{RequestType: protocol.OfferChecksumReq}
+	if err := c.WriteJSON(req); err != nil {
+		return false, err
+	}
+
+	offer := protocol.OfferChecksumRequest{
+		Path:              uploadToPath,
+		Size:              size,
+		Checksum:          checksum,
+		ChecksumAlgorithm: algorithm.Name,
+		Version:           protocol.NewVersion(protocol.CurrentVersion),
+	}
+	if err := c.WriteJSON(offer); err != nil {
+		return false, err
+	}
+
+	var resp protocol.OfferChecksumResponse
+	if err := readResponse(c, &resp); err != nil {
+		return false, err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return false, err
+	}
+
+	return resp.Uploaded, nil
+}
+
+// pauseUpload tells the server to pause the current upload so that it can be resumed later.
+func pauseUpload(c *websocket.Conn, uploadToPath string) error {
+	req := protocol.IncomingRequestType{RequestType: protocol.PauseUploadReq}
+	if err := c.WriteJSON(req); err != nil {
+		return err
+	}
+
+	if err := c.WriteJSON(protocol.PauseUploadRequest{Path: uploadToPath}); err != nil {
+		return err
+	}
+
+	return readFinalStatus(c)
+}
+
+// resumeOffset asks the server how much of the file it has from an earlier interrupted upload. The upload
+// resumes from that offset if the checksum the server has for those bytes matches the start of the local
+// file, otherwise it starts over at 0. The upload can only be resumed if it was started with the same checksum
+// algorithm. The returned hasher has already been fed the bytes before the offset.
+func resumeOffset(c *websocket.Conn, f *os.File, uploadToPath string, algorithm ft.ChecksumAlgorithm) (int64, hash.Hash, error) {
+	req := protocol.IncomingRequestType{RequestType: protocol.FileInfoReq}
+	if err := c.WriteJSON(req); err != nil {
+		return 0, nil, err
+	}
+
+	if err := c.WriteJSON(protocol.FileInfoRequest{Path: uploadToPath}); err != nil {
+		return 0, nil, err
+	}
+
+	var fileInfo protocol.FileInfoResponse
+	if err := readResponse(c, &fileInfo); err != nil {
+		return 0, nil, err
+	}
+
+	if err := readFinalStatus(c); err != nil {
+		return 0, nil, err
+	}
+
+	if fileInfo.UploadOffset == 0 || fileInfo.ChecksumAlgorithm != algorithm.Name {
+		return 0, algorithm.New(), nil
+	}
+
+	hasher := algorithm.New()
+	if _, err := io.CopyN(hasher, f, fileInfo.UploadOffset); err != nil {
+		// The local file is shorter than what the server has, so it must have changed.
+		return 0, algorithm.New(), nil
+	}
+
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != fileInfo.CurrentChecksum {
+		return 0, algorithm.New(), nil
+	}
+
+	return fileInfo.UploadOffset, hasher, nil
+}
@@ -0,0 +1,221 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	adminURL         string
+	adminInsecure    bool
+	adminProjectID   int
+	adminRevokeToken bool
+)
+
+// cancelResponse is returned by the admin API when sessions are cancelled.
+type cancelResponse struct {
+	Cancelled int `json:"cancelled"`
+}
+
+// registerAdminRoutes adds the admin API, which requires the admin_token as a bearer token. The API is
+// only served when an admin_token is configured.
+func registerAdminRoutes(e *echo.Echo) {
+	token := viper.GetString(keyAdminToken)
+	if token == "" {
+		log.Infof("No %s configured, admin API is disabled", keyAdminToken)
+		return
+	}
+
+	g := e.Group("/admin", middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	}))
+	g.GET("/sessions", listSessions)
+	g.DELETE("/sessions/:id", cancelSession)
+	g.DELETE("/projects/:id/sessions", cancelProjectSessions)
+	g.POST("/uploads/sweep", sweepUploads)
+}
+
+func listSessions(c echo.Context) error {
+	return c.JSON(http.StatusOK, ft.Sessions())
+}
+
+// cancelSession cancels a session by its ID. If the revoke_token query parameter is true then the
+// session token the session used, if any, is revoked as well.
+func cancelSession(c echo.Context) error {
+	revokeToken, _ := strconv.ParseBool(c.QueryParam("revoke_token"))
+	if !ft.CancelSession(c.Param("id"), revokeToken) {
+		return echo.NewHTTPError(http.StatusNotFound, "no such session")
+	}
+
+	log.Infof("Admin cancelled session %s", c.Param("id"))
+	return c.JSON(http.StatusOK, cancelResponse{Cancelled: 1})
+}
+
+func cancelProjectSessions(c echo.Context) error {
+	projectID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid project id")
+	}
+
+	revokeTokens, _ := strconv.ParseBool(c.QueryParam("revoke_token"))
+	count := ft.CancelProjectSessions(projectID, revokeTokens)
+	log.Infof("Admin cancelled %d sessions for project %d", count, projectID)
+
+	return c.JSON(http.StatusOK, cancelResponse{Cancelled: count})
+}
+
+// adminCmd represents the admin command
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage a running mcftservd",
+	Long: `Manage a running mcftservd through its admin API. The admin_token setting must be the same as the
+server's. By default the server is reached on localhost at the port of listen_address.`,
+}
+
+// adminSessionsCmd represents the admin sessions command
+var adminSessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "List the sessions running on the server",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var infos []ft.SessionInfo
+		if err := adminRequest(http.MethodGet, "/admin/sessions", &infos); err != nil {
+			log.Fatalf("Unable to list sessions: %s", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SESSION\tUSER\tPROJECT\tSTARTED\tTRANSFER\tPATH\tBYTES\tRATE")
+		for _, info := range infos {
+			rate := ""
+			if info.Transfer != "" {
+				rate = fmt.Sprintf("%.0f/s", info.BytesPerSecond)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%d\t%s\n", info.SessionID, info.UserEmail, info.ProjectID,
+				info.StartedAt.Local().Format("2006-01-02 15:04:05"), info.Transfer, info.Path, info.Bytes, rate)
+		}
+		_ = w.Flush()
+	},
+}
+
+// adminCancelCmd represents the admin cancel command
+var adminCancelCmd = &cobra.Command{
+	Use:   "cancel [session-id]",
+	Short: "Cancel a session, or all the sessions for a project",
+	Long: `Cancel a session, or with --project all the sessions for a project. The upload a session is in
+the middle of is thrown away rather than left for the client to resume.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var path string
+		switch {
+		case len(args) == 1 && adminProjectID == 0:
+			path = "/admin/sessions/" + args[0]
+		case len(args) == 0 && adminProjectID != 0:
+			path = fmt.Sprintf("/admin/projects/%d/sessions", adminProjectID)
+		default:
+			log.Fatalf("Give either a session id or --project")
+		}
+
+		if adminRevokeToken {
+			path += "?revoke_token=true"
+		}
+
+		var resp cancelResponse
+		if err := adminRequest(http.MethodDelete, path, &resp); err != nil {
+			log.Fatalf("Unable to cancel: %s", err)
+		}
+
+		fmt.Printf("Cancelled %d session(s)\n", resp.Cancelled)
+	},
+}
+
+// adminRequest sends a request to the admin API and decodes the JSON response into resp.
+func adminRequest(method, path string, resp interface{}) error {
+	token := viper.GetString(keyAdminToken)
+	if token == "" {
+		return fmt.Errorf("%s is not set", keyAdminToken)
+	}
+
+	req, err := http.NewRequest(method, adminBaseURL()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if adminInsecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	r, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(r.Body)
+		return fmt.Errorf("%s: %s", r.Status, body)
+	}
+
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// adminBaseURL is --url if it was given, otherwise the server on localhost.
+func adminBaseURL() string {
+	if adminURL != "" {
+		return adminURL
+	}
+
+	scheme := "http"
+	if viper.GetString(keyTLSCert) != "" {
+		scheme = "https"
+	}
+
+	_, port, err := net.SplitHostPort(viper.GetString(keyListenAddress))
+	if err != nil {
+		log.Fatalf("Unable to get port from %s: %s", keyListenAddress, err)
+	}
+
+	return fmt.Sprintf("%s://localhost:%s", scheme, port)
+}
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+	adminCmd.AddCommand(adminSessionsCmd)
+	adminCmd.AddCommand(adminCancelCmd)
+
+	adminCmd.PersistentFlags().StringVar(&adminURL, "url", "", "URL of the server (default localhost at the listen address port)")
+	adminCmd.PersistentFlags().BoolVar(&adminInsecure, "insecure", false, "Don't verify the server's certificate")
+	adminCancelCmd.Flags().IntVar(&adminProjectID, "project", 0, "Cancel all the sessions for the project")
+	adminCancelCmd.Flags().BoolVar(&adminRevokeToken, "revoke-token", false, "Also revoke the session tokens the sessions used")
+}
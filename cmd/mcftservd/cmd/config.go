@@ -0,0 +1,211 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	mcdb "github.com/materials-commons/gomcdb"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/subosito/gotenv"
+)
+
+// Configuration keys. Each can be set in the config file, overridden by an environment variable named
+// MCFTSERVD_ followed by the key in upper case, and overridden again by the flag with the same name
+// (with "-" in place of "_").
+const (
+	keyListenAddress       = "listen_address"
+	keyTLSCert             = "tls_cert"
+	keyTLSKey              = "tls_key"
+	keyMCFSDir             = "mcfs_dir"
+	keyDBDSN               = "db_dsn"
+	keyDotenvPath          = "dotenv_path"
+	keyMaxBlockSize        = "max_block_size"
+	keyMaxFileSize         = "max_file_size"
+	keyProjectQuota        = "project_quota"
+	keyUserQuota           = "user_quota"
+	keyUploadExpiration    = "upload_expiration"
+	keyLogLevel            = "log_level"
+	keyShutdownTimeout     = "shutdown_timeout"
+	keyMinFreeSpace        = "min_free_space"
+	keyAuditLog            = "audit_log"
+	keyAdminToken          = "admin_token"
+	keyUploadSweepInterval = "upload_sweep_interval"
+	keyUploadSweepDryRun   = "upload_sweep_dry_run"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Work with the mcftservd configuration",
+}
+
+// configShowCmd represents the config show command
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the configuration mcftservd would run with",
+	Long: `Show the configuration mcftservd would run with, after the config file, environment variables
+and flags have been applied. The database password and admin token are masked.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if f := viper.ConfigFileUsed(); f != "" {
+			fmt.Printf("# config file: %s\n", f)
+		}
+
+		keys := viper.AllKeys()
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := viper.GetString(key)
+			if key == keyDBDSN {
+				value = maskDSNPassword(dbDSN())
+			}
+			if key == keyAdminToken && value != "" {
+				value = "****"
+			}
+			fmt.Printf("%s = '%s'\n", key, value)
+		}
+	},
+}
+
+// initConfig reads the config file, and loads the dotenv file if there is one so that the variables
+// it sets can be used to configure the server.
+func initConfig() {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	} else {
+		if home, err := os.UserHomeDir(); err == nil {
+			viper.AddConfigPath(home)
+		}
+		viper.AddConfigPath("/etc/mcftservd")
+		viper.SetConfigName(".mcftservd")
+	}
+
+	viper.SetEnvPrefix("MCFTSERVD")
+	viper.AutomaticEnv()
+
+	if err := viper.ReadInConfig(); err != nil {
+		if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound || cfgFile != "" {
+			log.Fatalf("Reading config file failed: %s", err)
+		}
+	}
+
+	// Existing deployments set these with the environment variables they used before there was a config
+	// file, so those are used when nothing else sets them.
+	viper.SetDefault(keyDotenvPath, os.Getenv("MC_DOTENV_PATH"))
+	if path := viper.GetString(keyDotenvPath); path != "" {
+		if err := gotenv.Load(path); err != nil {
+			log.Fatalf("Loading dotenv file path %s failed: %s", path, err)
+		}
+	}
+	viper.SetDefault(keyMCFSDir, os.Getenv("MCFS_DIR"))
+}
+
+// applyConfig validates the configuration and sets up the server to use it.
+func applyConfig() {
+	level, err := log.ParseLevel(viper.GetString(keyLogLevel))
+	if err != nil {
+		log.Fatalf("Invalid %s '%s'", keyLogLevel, viper.GetString(keyLogLevel))
+	}
+	log.SetLevel(level)
+
+	if ft.MCFSRoot = viper.GetString(keyMCFSDir); ft.MCFSRoot == "" {
+		log.Fatalf("%s must be set, either in the config file, or with --mcfs-dir or MCFS_DIR", keyMCFSDir)
+	}
+
+	if (viper.GetString(keyTLSCert) == "") != (viper.GetString(keyTLSKey) == "") {
+		log.Fatalf("%s and %s must both be set to serve TLS", keyTLSCert, keyTLSKey)
+	}
+
+	if ft.MaxBlockSize = viper.GetInt64(keyMaxBlockSize); ft.MaxBlockSize <= 0 {
+		log.Fatalf("%s must be greater than 0", keyMaxBlockSize)
+	}
+
+	ft.MaxFileSize = viper.GetInt64(keyMaxFileSize)
+	ft.ProjectQuota = viper.GetInt64(keyProjectQuota)
+	ft.UserQuota = viper.GetInt64(keyUserQuota)
+	ft.UploadExpiration = viper.GetDuration(keyUploadExpiration)
+
+	if path := viper.GetString(keyAuditLog); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Fatalf("Unable to open %s %s: %s", keyAuditLog, path, err)
+		}
+		ft.SetAuditLog(f)
+	}
+}
+
+// dbDSN is the configured DSN, or the DSN built from the MC_DB_* environment variables if there isn't one.
+func dbDSN() string {
+	if dsn := viper.GetString(keyDBDSN); dsn != "" {
+		return dsn
+	}
+
+	return mcdb.MakeDSNFromEnv()
+}
+
+// maskDSNPassword replaces the password in a "user:password@..." DSN so it can be shown.
+func maskDSNPassword(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	if at == -1 {
+		return dsn
+	}
+
+	colon := strings.Index(dsn[:at], ":")
+	if colon == -1 {
+		return dsn
+	}
+
+	return dsn[:colon+1] + "****" + dsn[at:]
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+
+	flags := rootCmd.PersistentFlags()
+	flags.String("listen-address", ":1423", "Address to listen on")
+	flags.String("tls-cert", "", "TLS certificate file, serves TLS when given along with --tls-key")
+	flags.String("tls-key", "", "TLS key file")
+	flags.String("mcfs-dir", "", "Directory uploaded files are stored in (default $MCFS_DIR)")
+	flags.String("db-dsn", "", "Database DSN (default built from the MC_DB_* environment variables)")
+	flags.String("dotenv-path", "", "Dotenv file to load environment variables from (default $MC_DOTENV_PATH)")
+	flags.Int64("max-block-size", ft.MaxBlockSize, "Largest block in bytes a client can send")
+	flags.Int64("max-file-size", 0, "Largest file in bytes that can be uploaded, 0 for no limit")
+	flags.Int64("project-quota", 0, "Most bytes the files in a project can use, 0 for no limit")
+	flags.Int64("user-quota", 0, "Most bytes the files a user has uploaded can use, 0 for no limit")
+	flags.Duration("upload-expiration", ft.UploadExpiration, "How long an interrupted upload is kept to be resumed")
+	flags.String("log-level", "info", "Log level (debug, info, warn, error)")
+	flags.Duration("shutdown-timeout", 20*time.Second, "How long to wait for sessions to pause their uploads when shutting down, supervisord stopwaitsecs must be longer")
+	flags.Int64("min-free-space", 1024*1024*1024, "Free bytes needed in the MCFS directory for the server to report itself healthy")
+	flags.Duration("upload-sweep-interval", time.Hour, "How often to remove expired partial uploads, 0 to never remove them")
+	flags.Bool("upload-sweep-dry-run", false, "Only log the expired partial uploads that would be removed")
+	flags.String("admin-token", "", "Bearer token for the admin API, the admin API is disabled if not set")
+	flags.String("audit-log", "", "File to append a JSON record of each transfer to, no audit log if not set")
+
+	for _, key := range []string{
+		keyListenAddress, keyTLSCert, keyTLSKey, keyMCFSDir, keyDBDSN, keyDotenvPath, keyMaxBlockSize,
+		keyMaxFileSize, keyProjectQuota, keyUserQuota, keyUploadExpiration, keyLogLevel, keyShutdownTimeout,
+		keyMinFreeSpace, keyAuditLog, keyAdminToken, keyUploadSweepInterval, keyUploadSweepDryRun,
+	} {
+		_ = viper.BindPFlag(key, flags.Lookup(strings.ReplaceAll(key, "_", "-")))
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/labstack/echo/v4"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/spf13/viper"
+)
+
+// Version is the version of mcftservd, set at build time with
+// -ldflags "-X github.com/materials-commons/mcft/cmd/mcftservd/cmd.Version=..."
+var Version = "dev"
+
+// healthCheckTimeout is how long the checks can take. A stale NFS mount can hang file system calls
+// rather than failing them, so a check that hasn't finished in time is reported as failed.
+const healthCheckTimeout = 5 * time.Second
+
+// healthResponse is the body returned by /healthz and /readyz. Checks maps the name of each check to
+// "ok" or to why it failed.
+type healthResponse struct {
+	Status  string            `json:"status"`
+	Version string            `json:"version"`
+	Checks  map[string]string `json:"checks"`
+}
+
+// healthz reports whether the server can handle transfers: the database is reachable and the MCFS
+// directory is writable with enough free space.
+func healthz(c echo.Context) error {
+	resp := runHealthChecks(c.Request().Context())
+	return c.JSON(resp.httpStatus(), resp)
+}
+
+// readyz is healthz, but also reports the server as not ready once it has started shutting down, so that
+// load balancers stop sending it new sessions.
+func readyz(c echo.Context) error {
+	resp := runHealthChecks(c.Request().Context())
+	if ft.IsDraining() {
+		resp.Status = "shutting down"
+	}
+	return c.JSON(resp.httpStatus(), resp)
+}
+
+func (r *healthResponse) httpStatus() int {
+	if r.Status != "ok" {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusOK
+}
+
+func runHealthChecks(ctx context.Context) *healthResponse {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	resp := &healthResponse{Status: "ok", Version: Version, Checks: make(map[string]string)}
+	checks := map[string]func(ctx context.Context) error{
+		"database": checkDatabase,
+		"storage":  checkStorage,
+	}
+
+	for name, check := range checks {
+		resp.Checks[name] = "ok"
+		if err := runWithTimeout(ctx, check); err != nil {
+			log.Warnf("Health check %s failed: %s", name, err)
+			resp.Checks[name] = err.Error()
+			resp.Status = "failed"
+		}
+	}
+
+	return resp
+}
+
+// runWithTimeout runs check, giving up when ctx is done. The check is left running in the background
+// if it doesn't return, since a hung file system call can't be cancelled.
+func runWithTimeout(ctx context.Context, check func(ctx context.Context) error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	}
+}
+
+func checkDatabase(ctx context.Context) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDB.PingContext(ctx)
+}
+
+// checkStorage checks that the MCFS directory is there and can be written to, and that the file system
+// it is on has at least min_free_space bytes free.
+func checkStorage(_ context.Context) error {
+	root := ft.GetMCFSRoot()
+
+	finfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	if !finfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	f, err := os.CreateTemp(root, ".mcftservd-health-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(root, &stat); err != nil {
+		return err
+	}
+
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	if minFree := viper.GetInt64(keyMinFreeSpace); free < minFree {
+		return fmt.Errorf("%d bytes free on %s, need at least %d", free, root, minFree)
+	}
+
+	return nil
+}
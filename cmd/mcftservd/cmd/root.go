@@ -15,14 +15,20 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
-	mcdb "github.com/materials-commons/gomcdb"
 	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
-	"github.com/subosito/gotenv"
+	"github.com/spf13/viper"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -34,26 +40,28 @@ import (
 )
 
 var (
-	cfgFile    string
-	mcfsDir    string
-	dotenvPath string
-	db         *gorm.DB
-	upgrader   = websocket.Upgrader{}
+	cfgFile  string
+	db       *gorm.DB
+	upgrader = websocket.Upgrader{}
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "mcftservd",
 	Short: "Upload/download file server",
-	Long:  `Handles upload and download file requests for materials commons from the mcft client.`,
+	Long: `Handles upload and download file requests for materials commons from the mcft client.
+
+Settings are read from the config file (default $HOME/.mcftservd.yaml or /etc/mcftservd/.mcftservd.yaml),
+and can be overridden by MCFTSERVD_<SETTING> environment variables and then by flags. Run
+'mcftservd config show' to see the settings that would be used.`,
+	Args: cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		var err error
-		gormConfig := &gorm.Config{
-			Logger: logger.Default.LogMode(logger.Silent),
-		}
+		applyConfig()
+		openDB()
 
-		if db, err = gorm.Open(mysql.Open(mcdb.MakeDSNFromEnv()), gormConfig); err != nil {
-			log.Fatalf("Failed to open db (%s): %s", mcdb.MakeDSNFromEnv(), err)
+		stopSweeper := make(chan struct{})
+		if interval := viper.GetDuration(keyUploadSweepInterval); interval > 0 {
+			go ft.RunUploadSweeper(db, ft.GetMCFSRoot(), interval, viper.GetBool(keyUploadSweepDryRun), stopSweeper)
 		}
 
 		e := echo.New()
@@ -61,11 +69,86 @@ var rootCmd = &cobra.Command{
 		e.HidePort = true
 		e.Use(middleware.Recover())
 		e.GET("/ws", handleUploadDownloadConnection)
+		e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+		e.GET("/healthz", healthz)
+		e.GET("/readyz", readyz)
+		registerAdminRoutes(e)
+
+		s, err := newServer()
+		if err != nil {
+			log.Fatalf("Unable to set up server: %s", err)
+		}
 
-		e.Logger.Fatal(e.Start(":1423"))
+		go func() {
+			if err := e.StartServer(s); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Server failed: %s", err)
+			}
+		}()
+
+		waitForShutdown(e)
+		close(stopSweeper)
 	},
 }
 
+// openDB opens the database, exiting if it can't.
+func openDB() {
+	var err error
+	gormConfig := &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	}
+
+	if db, err = gorm.Open(mysql.Open(dbDSN()), gormConfig); err != nil {
+		log.Fatalf("Failed to open db (%s): %s", maskDSNPassword(dbDSN()), err)
+	}
+}
+
+// waitForShutdown waits for a SIGTERM (or an interrupt), then shuts down gracefully. New connections are
+// no longer accepted, and the sessions that are running are given what is left of shutdown_timeout to
+// pause their uploads so that clients can resume them once the server is back. Shutting down takes at most
+// shutdown_timeout plus a second, so whatever stops the server must wait at least that long before
+// killing it (see stopwaitsecs in operations/supervisord.d/mcftservd.ini).
+func waitForShutdown(e *echo.Echo) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
+
+	timeout := viper.GetDuration(keyShutdownTimeout)
+	log.Infof("Received %s, shutting down and draining sessions for up to %s", sig, timeout)
+
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Errorf("Failed to stop accepting connections: %s", err)
+	}
+
+	if !ft.DrainSessions(time.Until(deadline)) {
+		log.Warnf("Sessions still running after %s, exiting anyway", timeout)
+	}
+}
+
+// newServer returns the server to run, which serves TLS when a certificate and key are configured.
+func newServer() (*http.Server, error) {
+	s := &http.Server{Addr: viper.GetString(keyListenAddress)}
+
+	certFile := viper.GetString(keyTLSCert)
+	if certFile == "" {
+		return s, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, viper.GetString(keyTLSKey))
+	if err != nil {
+		return nil, err
+	}
+
+	s.TLSConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	return s, nil
+}
+
 func handleUploadDownloadConnection(c echo.Context) error {
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
@@ -77,19 +160,12 @@ func handleUploadDownloadConnection(c echo.Context) error {
 		_ = ws.Close()
 	}()
 
-	if err := fileTransferHandler.Run(); err != nil {
-		status := ft.Error2Status(err)
-		_ = ws.WriteJSON(status)
-	}
+	// Run reports any error to the client before ending the session.
+	_ = fileTransferHandler.Run()
 
 	return nil
 }
 
-func showEnv() {
-	fmt.Printf("MCFS_ROOT = '%s'\n", ft.GetMCFSRoot())
-	fmt.Printf("DSN = '%s'\n", mcdb.MakeDSNFromEnv())
-}
-
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -100,34 +176,7 @@ func Execute() {
 }
 
 func init() {
-	if err := gotenv.Load(MustGetDotenvPath()); err != nil {
-		log.Fatalf("Loading dotenv file path %s failed: %s", dotenvPath, err)
-	}
+	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.mcftservd.yaml)")
-
-	mcfsDir = os.Getenv("MCFS_DIR")
-	if mcfsDir == "" {
-		log.Fatalf("MCFS_DIR environment variable not set")
-	}
-}
-
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if err := gotenv.Load(MustGetDotenvPath()); err != nil {
-		log.Fatalf("Loading dotenv file path %s failed: %s", dotenvPath, err)
-	}
-}
-
-func MustGetDotenvPath() string {
-	if dotenvPath != "" {
-		return dotenvPath
-	}
-
-	dotenvPath = os.Getenv("MC_DOTENV_PATH")
-	if dotenvPath == "" {
-		log.Fatal("MC_DOTENV_PATH not set")
-	}
-
-	return dotenvPath
 }
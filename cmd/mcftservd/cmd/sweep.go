@@ -0,0 +1,84 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/labstack/echo/v4"
+	"github.com/materials-commons/mcft/pkg/ft"
+	"github.com/spf13/cobra"
+)
+
+var sweepDryRun bool
+
+// sweepUploads sweeps the expired uploads. The sweep has to run in the server so that uploads its
+// sessions are resuming aren't removed. If the dry_run query parameter is true then the expired uploads
+// are only listed.
+func sweepUploads(c echo.Context) error {
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+	expired, err := ft.SweepExpiredUploads(db, ft.GetMCFSRoot(), dryRun)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	log.Infof("Admin swept %d expired uploads (dry run: %t)", len(expired), dryRun)
+	return c.JSON(http.StatusOK, expired)
+}
+
+// sweepUploadsCmd represents the admin sweep-uploads command
+var sweepUploadsCmd = &cobra.Command{
+	Use:   "sweep-uploads",
+	Short: "Remove expired partial uploads",
+	Long: `Remove the partial uploads that clients never resumed and that have passed their expiration, from
+both the MCFS directory and the database. With --dry-run the expired uploads are listed but not removed.
+The sweep is run by the server, which also does this in the background every upload_sweep_interval.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "/admin/uploads/sweep"
+		if sweepDryRun {
+			path += "?dry_run=true"
+		}
+
+		var expired []ft.ExpiredUpload
+		if err := adminRequest(http.MethodPost, path, &expired); err != nil {
+			log.Fatalf("Unable to sweep expired uploads: %s", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PROJECT\tUSER\tPATH\tFILE\tBYTES\tEXPIRED")
+		for _, upload := range expired {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%d\t%s\n", upload.ProjectID, upload.UserID, upload.Path, upload.FileID,
+				upload.Bytes, upload.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		_ = w.Flush()
+
+		if sweepDryRun {
+			fmt.Printf("%d expired upload(s) would be removed\n", len(expired))
+		} else {
+			fmt.Printf("Removed %d expired upload(s)\n", len(expired))
+		}
+	},
+}
+
+func init() {
+	adminCmd.AddCommand(sweepUploadsCmd)
+	sweepUploadsCmd.Flags().BoolVar(&sweepDryRun, "dry-run", false, "List the expired uploads without removing them")
+}
@@ -4,14 +4,17 @@ go 1.15
 
 require (
 	github.com/apex/log v1.9.0
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/gorilla/websocket v1.4.2
 	github.com/labstack/echo/v4 v4.2.0
 	github.com/materials-commons/gomcdb v0.0.0-20211103183444-241b4698d28b
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/prometheus/client_golang v1.11.1
 	github.com/saracen/walker v0.1.2
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
 	github.com/subosito/gotenv v1.2.0
 	gorm.io/driver/mysql v1.0.4
 	gorm.io/gorm v1.21.1
+	lukechampine.com/blake3 v1.1.7
 )
@@ -0,0 +1,122 @@
+package ft
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// auditLog is where audit records are written, one JSON object per line. Nothing is recorded until
+// SetAuditLog is called.
+var auditLog = struct {
+	sync.Mutex
+	w io.Writer
+}{}
+
+// SetAuditLog sets where audit records are written. A nil writer turns off the audit log.
+func SetAuditLog(w io.Writer) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	auditLog.w = w
+}
+
+// auditRecord records a transfer, or an attempt at one, so that it is possible to find out who uploaded
+// a file and when. Result is "ok", "interrupted" if the session ended part way through an upload, or the
+// name of the error code the client was sent.
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	SessionID       string    `json:"session_id"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Action          string    `json:"action"`
+	UserID          int       `json:"user_id,omitempty"`
+	UserEmail       string    `json:"user_email,omitempty"`
+	ProjectID       int       `json:"project_id,omitempty"`
+	Path            string    `json:"path,omitempty"`
+	FileID          int       `json:"file_id,omitempty"`
+	Bytes           int64     `json:"bytes,omitempty"`
+	Checksum        string    `json:"checksum,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+	Dedup           string    `json:"dedup,omitempty"`
+	Result          string    `json:"result"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Audit actions.
+const (
+	auditAuthenticate  = "authenticate"
+	auditUpload        = "upload"
+	auditPauseUpload   = "pause_upload"
+	auditOfferChecksum = "offer_checksum"
+	auditDownload      = "download"
+)
+
+// Dedup outcomes, for records of files that were added to a project.
+const (
+	dedupNew      = "new"
+	dedupExisting = "existing"
+)
+
+// newSessionID returns a random ID that identifies a session in the audit log and in log messages.
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// audit writes record to the audit log, filling in the session, user and project, and the result
+// from err.
+func (h *FileTransferHandler) audit(record auditRecord, err error) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	if auditLog.w == nil {
+		return
+	}
+
+	record.Time = time.Now()
+	record.SessionID = h.SessionID
+	record.RemoteAddr = h.ws.RemoteAddr().String()
+	record.UserID = h.User.ID
+	record.UserEmail = h.User.Email
+	if h.Project != nil {
+		record.ProjectID = h.Project.ID
+	}
+
+	if record.Result == "" {
+		record.Result = "ok"
+	}
+	if err != nil {
+		record.Result = Error2Status(err).ErrorCode.String()
+		record.Error = err.Error()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Failed to encode audit record: %s", err)
+		return
+	}
+
+	if _, err := auditLog.w.Write(append(line, '\n')); err != nil {
+		log.Errorf("Failed to write audit record: %s", err)
+	}
+}
+
+// uploadAuditRecord starts the audit record for the current upload. It must be called before the upload
+// is reset.
+func (h *FileTransferHandler) uploadAuditRecord(action string) auditRecord {
+	return auditRecord{
+		Action:          action,
+		Path:            h.upload.Path,
+		FileID:          h.File.ID,
+		Bytes:           h.upload.Offset,
+		DurationSeconds: time.Since(h.uploadStarted).Seconds(),
+	}
+}
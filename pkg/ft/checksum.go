@@ -0,0 +1,94 @@
+package ft
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// ChecksumAlgorithm is an algorithm that files and blocks can be checksummed with. The same
+// registry is used by the server and the mcft client so that both agree on the names.
+type ChecksumAlgorithm struct {
+	Name string
+	New  func() hash.Hash
+
+	// Dedup is true if the checksum is strong enough to decide that two files have the same
+	// contents. Uploads checksummed with an algorithm that isn't are never pointed at an
+	// existing upload.
+	Dedup bool
+}
+
+var ErrUnsupportedChecksumAlgorithm = errors.New("unsupported checksum algorithm")
+
+// DefaultChecksumAlgorithm is used when a request doesn't name an algorithm, which is what clients
+// from before there was a choice of algorithms do.
+const DefaultChecksumAlgorithm = "md5"
+
+// checksumAlgorithms are the supported algorithms in order of preference. MD5 comes first because
+// existing files only have MD5 checksums, so uploads checksummed with anything else are never deduped
+// against them. Other algorithms are only used when a client asks for them.
+var checksumAlgorithms = []ChecksumAlgorithm{
+	{Name: "md5", New: md5.New, Dedup: true},
+	{Name: "sha256", New: sha256.New, Dedup: true},
+	{Name: "blake3", New: func() hash.Hash { return blake3.New(32, nil) }, Dedup: true},
+	{Name: "xxhash", New: func() hash.Hash { return xxhash.New() }, Dedup: false},
+}
+
+// ChecksumAlgorithmNames returns the names of the supported algorithms in order of preference.
+func ChecksumAlgorithmNames() []string {
+	names := make([]string, 0, len(checksumAlgorithms))
+	for _, algorithm := range checksumAlgorithms {
+		names = append(names, algorithm.Name)
+	}
+
+	return names
+}
+
+// LookupChecksumAlgorithm returns the algorithm with the given name. An empty name is the default
+// algorithm.
+func LookupChecksumAlgorithm(name string) (ChecksumAlgorithm, error) {
+	if name == "" {
+		name = DefaultChecksumAlgorithm
+	}
+
+	for _, algorithm := range checksumAlgorithms {
+		if algorithm.Name == name {
+			return algorithm, nil
+		}
+	}
+
+	return ChecksumAlgorithm{}, fmt.Errorf("%w: %s", ErrUnsupportedChecksumAlgorithm, name)
+}
+
+// Checksum returns the hex encoded checksum of data.
+func (a ChecksumAlgorithm) Checksum(data []byte) string {
+	hasher := a.New()
+	_, _ = hasher.Write(data)
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+// StoredChecksum returns checksum in the form it is stored in for a file. MD5 checksums are stored
+// as is, as they always have been. Other algorithms are prefixed with the algorithm name, so that
+// looking up existing uploads by checksum only ever matches checksums from the same algorithm.
+func StoredChecksum(algorithm, checksum string) string {
+	if algorithm == "" || algorithm == DefaultChecksumAlgorithm {
+		return checksum
+	}
+
+	return algorithm + ":" + checksum
+}
+
+// ParseStoredChecksum splits a checksum stored by StoredChecksum into its algorithm and checksum.
+func ParseStoredChecksum(stored string) (algorithm, checksum string) {
+	if i := strings.Index(stored, ":"); i != -1 {
+		return stored[:i], stored[i+1:]
+	}
+
+	return DefaultChecksumAlgorithm, stored
+}
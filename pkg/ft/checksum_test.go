@@ -0,0 +1,41 @@
+package ft
+
+import "testing"
+
+func TestStoredChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		checksum  string
+		stored    string
+	}{
+		{algorithm: "md5", checksum: "d41d8cd98f00b204e9800998ecf8427e", stored: "d41d8cd98f00b204e9800998ecf8427e"},
+		{algorithm: "", checksum: "d41d8cd98f00b204e9800998ecf8427e", stored: "d41d8cd98f00b204e9800998ecf8427e"},
+		{algorithm: "sha256", checksum: "e3b0c442", stored: "sha256:e3b0c442"},
+		{algorithm: "blake3", checksum: "af1349b9", stored: "blake3:af1349b9"},
+		{algorithm: "xxhash", checksum: "ef46db37", stored: "xxhash:ef46db37"},
+	}
+
+	for _, test := range tests {
+		stored := StoredChecksum(test.algorithm, test.checksum)
+		if stored != test.stored {
+			t.Errorf("StoredChecksum(%q, %q) = %q, want %q", test.algorithm, test.checksum, stored, test.stored)
+		}
+
+		wantAlgorithm := test.algorithm
+		if wantAlgorithm == "" {
+			wantAlgorithm = DefaultChecksumAlgorithm
+		}
+		algorithm, checksum := ParseStoredChecksum(stored)
+		if algorithm != wantAlgorithm || checksum != test.checksum {
+			t.Errorf("ParseStoredChecksum(%q) = %q, %q, want %q, %q", stored, algorithm, checksum, wantAlgorithm, test.checksum)
+		}
+	}
+}
+
+// TestDefaultChecksumAlgorithmIsPreferred checks that clients that let the server choose get MD5, which
+// is what existing files are checksummed with.
+func TestDefaultChecksumAlgorithmIsPreferred(t *testing.T) {
+	if names := ChecksumAlgorithmNames(); names[0] != DefaultChecksumAlgorithm {
+		t.Fatalf("preferred checksum algorithm is %s, want %s", names[0], DefaultChecksumAlgorithm)
+	}
+}
@@ -0,0 +1,185 @@
+package ft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mcft/pkg/protocol"
+	"gorm.io/gorm"
+)
+
+// ErrFileUnavailable is returned when a file's entry exists but its contents can't be read. Nothing has
+// been sent to the client at that point, so the session can carry on with the next download.
+var ErrFileUnavailable = errors.New("file contents are unavailable")
+
+// downloadFile handles a DownloadReq. The response is a StatusResponse, followed (if there was no error) by a
+// FileInfo describing the path. If the path is a directory then a ListDirectoryResponse containing the entries
+// in the directory follows, and the client is responsible for requesting each entry it wants. If the path is
+// a file then the file contents follow as a series of FileBlockRequest messages that add up to FileInfo.Size.
+func (h *FileTransferHandler) downloadFile() error {
+	var downloadReq protocol.DownloadRequest
+	if err := h.ws.ReadJSON(&downloadReq); err != nil {
+		log.Errorf("Expected download msg, got err: %s", err)
+		return err
+	}
+
+	path, err := cleanProjectPath(downloadReq.Path)
+	if err != nil {
+		return err
+	}
+
+	file, err := h.findFileOrDirByPath(path)
+	if err != nil {
+		return err
+	}
+
+	if file.IsDir() {
+		return h.sendDirectory(path, file)
+	}
+
+	start := time.Now()
+	err = h.sendFile(path, file, downloadReq.BinaryBlocks())
+	h.audit(auditRecord{
+		Action:          auditDownload,
+		Path:            path,
+		FileID:          file.ID,
+		Bytes:           int64(file.Size),
+		Checksum:        file.Checksum,
+		DurationSeconds: time.Since(start).Seconds(),
+	}, err)
+
+	return err
+}
+
+// findFileOrDirByPath looks up a clean path in the project. Directories are looked up directly by their path,
+// files are looked up by finding their directory and then the current version of the file in that directory.
+// If there is no such path then the error is ErrNotFound.
+func (h *FileTransferHandler) findFileOrDirByPath(path string) (*mcmodel.File, error) {
+	if dir, err := h.fileStore.FindDirByPath(h.Project.ID, path); err == nil {
+		return dir, nil
+	}
+
+	dir, err := h.fileStore.FindDirByPath(h.Project.ID, filepath.Dir(path))
+	if err == nil {
+		var file mcmodel.File
+		err = h.db.Where("directory_id = ?", dir.ID).
+			Where("name = ?", filepath.Base(path)).
+			Where("current = ?", true).
+			First(&file).Error
+		if err == nil {
+			return &file, nil
+		}
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+
+	return nil, err
+}
+
+func (h *FileTransferHandler) sendDirectory(path string, dir *mcmodel.File) error {
+	entries, err := h.listDirectory(path, dir)
+	if err != nil {
+		log.Errorf("Unable to list directory %s: %s", path, err)
+		return err
+	}
+
+	if err := h.writeResponse(path, toFileInfo(dir)); err != nil {
+		return err
+	}
+
+	return h.ws.WriteJSON(protocol.ListDirectoryResponse{Path: path, Status: "ok", IsDir: true, Files: entries})
+}
+
+// sendFile sends the contents of file. If binaryBlocks is true then the client supports receiving blocks as
+// binary messages.
+func (h *FileTransferHandler) sendFile(path string, file *mcmodel.File, binaryBlocks bool) error {
+	// ToUnderlyingFilePath takes into account UsesUUID, so if this file was deduped and points at the
+	// contents of another upload then we will read from that upload.
+	f, err := os.Open(file.ToUnderlyingFilePath(h.mcfsRoot))
+	if err != nil {
+		log.Errorf("Unable to open file %s for download: %s", file.ToUnderlyingFilePath(h.mcfsRoot), err)
+		return fmt.Errorf("%w: %s", ErrFileUnavailable, path)
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		log.Errorf("Unable to stat file %s for download: %s", file.ToUnderlyingFilePath(h.mcfsRoot), err)
+		return fmt.Errorf("%w: %s", ErrFileUnavailable, path)
+	}
+
+	fileInfo := toFileInfo(file)
+	fileInfo.Size = finfo.Size()
+	if err := h.writeResponse(path, fileInfo); err != nil {
+		return err
+	}
+
+	h.status.transferring(transferDownload, path, 0)
+	defer h.status.transferDone()
+
+	data := h.sendBuffer(finfo.Size())
+	fb := protocol.FileBlockRequest{Path: path}
+	if binaryBlocks {
+		fb.Version = protocol.NewVersion(protocol.VersionBinaryBlocks)
+	}
+	for {
+		n, err := f.Read(data)
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Failed reading file %s for download: %s", path, err)
+				return err
+			}
+			break
+		}
+
+		fb.Block = data[:n]
+		fb.ContentLength = int64(n)
+		if err := protocol.WriteFileBlock(h.ws, &fb); err != nil {
+			return err
+		}
+		fb.UploadOffset += int64(n)
+		h.status.progressed(fb.UploadOffset)
+	}
+
+	return nil
+}
+
+// sendBuffer returns the buffer to read the blocks of a file of size into. The session's buffer is only
+// grown as far as the file needs, so that downloading many small files doesn't allocate full size blocks.
+func (h *FileTransferHandler) sendBuffer(size int64) []byte {
+	switch {
+	case size > MaxBlockSize:
+		size = MaxBlockSize
+	case size < 1:
+		// A read into an empty buffer never reaches the end of the file.
+		size = 1
+	}
+
+	if int64(len(h.sendBuf)) < size {
+		h.sendBuf = make([]byte, size)
+	}
+
+	return h.sendBuf[:size]
+}
+
+func toFileInfo(file *mcmodel.File) protocol.FileInfo {
+	algorithm, checksum := ParseStoredChecksum(file.Checksum)
+	return protocol.FileInfo{
+		Name:              file.Name,
+		IsDir:             file.IsDir(),
+		Size:              int64(file.Size),
+		Checksum:          checksum,
+		ChecksumAlgorithm: algorithm,
+		UploadComplete:    true,
+		CreatedAt:         file.CreatedAt,
+		UpdatedAt:         file.UpdatedAt,
+	}
+}
@@ -2,7 +2,6 @@ package ft
 
 import (
 	"bytes"
-	"crypto/md5"
 	"errors"
 	"fmt"
 	"hash"
@@ -11,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/gorilla/websocket"
@@ -22,9 +22,17 @@ import (
 
 var ErrAlreadyAuthenticated = errors.New("already authenticated")
 var ErrBadProtocolSequence = errors.New("bad protocol sequence")
+var ErrChecksumMismatch = errors.New("checksums didn't match")
+var ErrNoProjectAccess = errors.New("no access to project")
+var ErrNotFound = errors.New("not found")
 var ErrNotAuthenticated = errors.New("not authenticated")
+var ErrUnexpectedOffset = errors.New("block offset does not match upload offset")
+var ErrUnknownRequestType = errors.New("unknown request type")
 
 type FileTransferHandler struct {
+	// SessionID identifies the session in the audit log and in log messages.
+	SessionID string
+
 	db           *gorm.DB
 	ws           *websocket.Conn
 	f            *os.File
@@ -36,32 +44,79 @@ type FileTransferHandler struct {
 	convStore    *store.ConversionStore
 	hasher       hash.Hash
 	mcfsRoot     string
+
+	// clientVersion is the protocol version the client sent when it authenticated.
+	clientVersion int
+
+	// sessionToken is the token the session authenticated with, nil if it authenticated with an API token.
+	sessionToken *sessionToken
+
+	// upload is the persisted state of the current upload.
+	upload *uploadState
+
+	// uploadStarted is when the current upload was started or resumed in this session.
+	uploadStarted time.Time
+
+	// blockBuf is reused to read blocks sent as binary messages.
+	blockBuf bytes.Buffer
+
+	// sendBuf is reused to read the blocks of files being downloaded.
+	sendBuf []byte
+
+	// status is what the admin API reports about the session.
+	status sessionStatus
 }
 
 func NewFileTransferHandler(ws *websocket.Conn, db *gorm.DB) *FileTransferHandler {
-	return &FileTransferHandler{
+	h := &FileTransferHandler{
+		SessionID:    newSessionID(),
 		ws:           ws,
 		db:           db,
 		projectStore: store.NewProjectStore(db),
 		fileStore:    store.NewFileStore(db, GetMCFSRoot()),
 		convStore:    store.NewConversionStore(db),
-		hasher:       md5.New(),
 		mcfsRoot:     GetMCFSRoot(),
 	}
+
+	h.status.info = SessionInfo{
+		SessionID:  h.SessionID,
+		RemoteAddr: ws.RemoteAddr().String(),
+		StartedAt:  time.Now(),
+	}
+
+	return h
 }
 
 func (h *FileTransferHandler) Run() error {
+	registerSession(h)
+	defer unregisterSession(h)
 	defer h.close()
 
-	if err := h.authenticate(); err != nil {
+	if IsDraining() {
+		_ = h.ws.WriteJSON(Error2Status(ErrShuttingDown))
+		return ErrShuttingDown
+	}
+
+	err := h.authenticate()
+	h.audit(auditRecord{Action: auditAuthenticate}, err)
+	if err != nil {
+		_ = h.ws.WriteJSON(Error2Status(err))
 		return err
 	}
+	if h.clientVersion >= protocol.VersionAuthResponse {
+		_ = h.ws.WriteJSON(Error2Status(nil))
+	}
+	h.status.authenticated(h)
 
 	var incomingRequest protocol.IncomingRequestType
 
 	for {
 		if err := h.ws.ReadJSON(&incomingRequest); err != nil {
 			//log.Errorf("Failed reading the incomingRequest: %s", err)
+			if h.status.isCancelled() {
+				_ = h.ws.WriteJSON(Error2Status(ErrSessionCancelled))
+				return ErrSessionCancelled
+			}
 			break
 		}
 
@@ -72,63 +127,100 @@ func (h *FileTransferHandler) Run() error {
 		case protocol.UploadFileReq:
 			err = h.startUploadFile()
 		case protocol.FinishUploadReq:
-			return h.computeAndValidateChecksum()
+			err = h.finishUpload()
 		case protocol.FileBlockReq:
 			err = h.writeFileBlock()
+		case protocol.DownloadReq:
+			err = h.downloadFile()
+		case protocol.ListDirectoryReq:
+			err = h.listDirectoryRequest()
+		case protocol.FileInfoReq:
+			err = h.fileInfo()
+		case protocol.PauseUploadReq:
+			err = h.pauseUpload()
+		case protocol.ServerInfoReq:
+			err = h.serverInfo()
+		case protocol.OfferChecksumReq:
+			err = h.offerChecksum()
+		case protocol.CreateSessionTokenReq:
+			err = h.createSessionToken()
+		case protocol.RevokeSessionTokenReq:
+			err = h.revokeSessionToken()
 		default:
-			err = fmt.Errorf("unknown request type: %d", incomingRequest.RequestType)
+			err = fmt.Errorf("%w: %d", ErrUnknownRequestType, incomingRequest.RequestType)
 		}
 
-		statusResponse := protocol.StatusResponse{
-			Status:  "continue",
-			IsError: false,
+		draining := IsDraining()
+		if h.status.isCancelled() {
+			// Whatever the request did, the read that failed when the session was cancelled is the reason
+			// it ended.
+			err = ErrSessionCancelled
+		} else if err == nil && draining && h.f != nil {
+			// The request left an upload open. Pause it, and tell the client the server is shutting down
+			// so that it resumes the upload, from the offset the server has, once the server is back.
+			if err = h.suspendUpload(); err != nil {
+				log.Errorf("Failed to pause upload for shutdown: %s", err)
+			} else {
+				err = ErrShuttingDown
+			}
 		}
 
-		if err != nil {
-			statusResponse.Status = fmt.Sprintf("%s", err)
-			statusResponse.IsError = true
-			_ = h.ws.WriteJSON(statusResponse)
+		_ = h.ws.WriteJSON(Error2Status(err))
+		if err != nil && !sessionCanContinue(err) {
 			return err
-		} else {
-			_ = h.ws.WriteJSON(statusResponse)
+		}
+
+		if draining {
+			// Any other request, such as finishing an upload, has been answered with its real result, but
+			// rather than carrying on the session ends here so the server can shut down.
+			return ErrShuttingDown
 		}
 	}
 
 	return nil
 }
 
-func (h *FileTransferHandler) close() {
-	if h.f != nil {
-		_ = h.f.Close()
-		finfo, err := os.Stat(h.File.ToUnderlyingFilePath(h.mcfsRoot))
-		if err == nil {
-			checksum := fmt.Sprintf("%x", h.hasher.Sum(nil))
-			if err := h.fileStore.UpdateMetadataForFileAndProject(h.File, checksum, h.Project.ID, finfo.Size()); err != nil {
-				log.Errorf("Failed to update metadata for file %d: %s", h.File.ID, err)
-			}
-			h.File.Checksum = checksum
-		}
+// sessionCanContinue returns true for errors that leave the session in a known state, so that the client
+// can carry on using it rather than having to reconnect.
+func sessionCanContinue(err error) bool {
+	switch {
+	case err == protocol.ErrBlockChecksumMismatch:
+		// Nothing was written, so the client can resend the block.
+		return true
+	case errors.Is(err, ErrNotFound):
+		// Looking up a path doesn't change anything, and clients check for paths that may not exist.
+		return true
+	case errors.Is(err, ErrFileUnavailable):
+		// The download failed before anything was sent, so the client can go on to its next download.
+		return true
+	default:
+		return false
+	}
+}
 
-		if h.pointedAtExistingFile() {
-			// There is already an uploaded that matches the checksum. At this point the file entry has been updated
-			// to point at it, so we can remove the physical file that was uploaded. Not that we are deleting the file
-			// pointed at by h.File.UUID. At this point h.File.UsesUUID has been updated, so we explicitly need to
-			// remove the file that was just uploaded (which went into a path determined by h.File.UUID).
-			if err := os.Remove(h.File.ToUnderlyingFilePathForUUID(h.mcfsRoot)); err != nil {
-				log.Errorf("Failed to remove file %s: %s", h.File.ToUnderlyingFilePathForUUID(h.mcfsRoot), err)
-			}
-			return
-		}
+// close cleans up when the session ends. If there is an upload in progress then the connection went away
+// before it was finished, so the partial file and its state are left for the client to resume. If the
+// session was cancelled then the upload is thrown away instead.
+func (h *FileTransferHandler) close() {
+	if h.f == nil {
+		return
+	}
 
-		// If we are here then this is a new file without a checksum match in the database. Check to see if
-		// we should create a converted version for viewing on the web.
-		if h.fileNeedsConverting() {
-			// Kick off a job to do a conversion
-			h.submitConversionJobOnFile()
-		}
+	record := h.uploadAuditRecord(auditUpload)
+	if h.status.isCancelled() {
+		log.Infof("Session %s cancelled, discarding upload of %s", h.SessionID, h.upload.Path)
+		h.abortUpload()
+		h.audit(record, ErrSessionCancelled)
+		return
 	}
+
+	_ = h.f.Close()
+	record.Result = "interrupted"
+	h.audit(record, nil)
 }
 
+// authenticate handles the AuthenticateReq that must start every session. On success clients that
+// support it are sent an AuthenticateResponse identifying the user and project.
 func (h *FileTransferHandler) authenticate() error {
 	var incomingRequest protocol.IncomingRequestType
 	if err := h.ws.ReadJSON(&incomingRequest); err != nil {
@@ -136,7 +228,7 @@ func (h *FileTransferHandler) authenticate() error {
 	}
 
 	if incomingRequest.RequestType != protocol.AuthenticateReq {
-		return errors.New("not authenticated")
+		return ErrNotAuthenticated
 	}
 
 	var authReq protocol.AuthenticateRequest
@@ -144,28 +236,88 @@ func (h *FileTransferHandler) authenticate() error {
 		return err
 	}
 
-	var user mcmodel.User
+	var (
+		user mcmodel.User
+		err  error
+	)
+
+	if authReq.SessionToken != "" {
+		err = h.authenticateWithSessionToken(&authReq, &user)
+	} else {
+		err = h.db.Where("api_token = ?", authReq.APIToken).First(&user).Error
+	}
 
-	if err := h.db.Where("api_token = ?", authReq.APIToken).First(&user).Error; err != nil {
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotAuthenticated
+		}
 		return err
 	}
 
 	h.User = user
 
+	// Checked even for session tokens, in case the user was removed from the project after the token
+	// was created.
 	if !h.projectStore.UserCanAccessProject(h.User.ID, authReq.ProjectID) {
-		return ErrNotAuthenticated
+		return ErrNoProjectAccess
 	}
 
-	var err error
 	h.Project, err = h.projectStore.FindProject(authReq.ProjectID)
 	if err != nil {
 		return err
 	}
 
+	h.clientVersion = authReq.Version.Number()
+	if h.clientVersion < protocol.VersionAuthResponse {
+		return nil
+	}
+
+	return h.writeResponse("", protocol.AuthenticateResponse{
+		UserID:      h.User.ID,
+		UserName:    h.User.Name,
+		UserEmail:   h.User.Email,
+		ProjectID:   h.Project.ID,
+		ProjectName: h.Project.Name,
+		Version:     protocol.NewVersion(protocol.CurrentVersion),
+	})
+}
+
+// checkWriteAllowed returns ErrPathNotAllowed if the session authenticated with a session token that is
+// restricted to a part of the project that path isn't in.
+func (h *FileTransferHandler) checkWriteAllowed(path string) error {
+	if h.sessionToken == nil || h.sessionToken.PathPrefix == "" {
+		return nil
+	}
+
+	if !pathIsUnder(path, h.sessionToken.PathPrefix) {
+		return fmt.Errorf("%w: %s is outside of %s", ErrPathNotAllowed, path, h.sessionToken.PathPrefix)
+	}
+
 	return nil
 }
 
-func (h *FileTransferHandler) startUploadFile() error {
+// authenticateWithSessionToken loads the user a session token was created for. The token only grants
+// access to the project it was created for, which is the project used when the request doesn't name one.
+func (h *FileTransferHandler) authenticateWithSessionToken(authReq *protocol.AuthenticateRequest, user *mcmodel.User) error {
+	token, err := lookupSessionToken(authReq.SessionToken)
+	if err != nil {
+		return err
+	}
+
+	if authReq.ProjectID == 0 {
+		authReq.ProjectID = token.ProjectID
+	}
+
+	if authReq.ProjectID != token.ProjectID {
+		return ErrNoProjectAccess
+	}
+
+	h.sessionToken = token
+
+	return h.db.First(user, token.UserID).Error
+}
+
+func (h *FileTransferHandler) startUploadFile() (err error) {
 	var (
 		uploadReq protocol.UploadFileRequest
 		file      *mcmodel.File
@@ -175,32 +327,331 @@ func (h *FileTransferHandler) startUploadFile() error {
 		return err
 	}
 
-	dir, err := h.getOrCreateDirectory(filepath.Dir(uploadReq.Path))
+	// Only one file can be uploaded at a time in a session.
+	if h.f != nil {
+		return ErrBadProtocolSequence
+	}
+
+	path, algorithm, err := h.checkUploadRequest(&uploadReq)
 	if err != nil {
-		log.Errorf("getOrCreateDirectory failed for %s: %s", filepath.Dir(uploadReq.Path), err)
+		// Rejected uploads are audited with the path the client asked for, as they may be attempts to
+		// write where the client isn't allowed to.
+		h.audit(auditRecord{Action: auditUpload, Path: uploadReq.Path}, err)
 		return err
 	}
 
-	name := filepath.Base(uploadReq.Path)
-	file, err = h.fileStore.CreateFile(name, h.Project.ID, dir.ID, h.User.ID, getMimeType(name))
+	// Two sessions uploading to the same path would each throw away the other's file.
+	if err := claimUpload(h, path); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			h.status.transferDone()
+		}
+	}()
+
+	h.uploadStarted = time.Now()
+
+	if uploadReq.UploadOffset > 0 {
+		if err := h.resumeUploadFile(path, uploadReq.UploadOffset, algorithm); err != nil {
+			return err
+		}
+		h.upload.Size = uploadReq.Size
+		h.status.transferring(transferUpload, path, h.upload.Offset)
+		return nil
+	}
+
+	// The client is starting over, so throw away any partial upload it may have previously started. Its
+	// state is about to be replaced, after which nothing would refer to its file.
+	if err := h.discardPartialUpload(path); err != nil {
+		return err
+	}
+
+	file, err = h.createFileEntry(path)
 	if err != nil {
-		log.Errorf("CreateFile failed: %s", err)
 		return err
 	}
 
+	state := &uploadState{
+		ProjectID:         h.Project.ID,
+		UserID:            h.User.ID,
+		Path:              path,
+		FileID:            file.ID,
+		Size:              uploadReq.Size,
+		ChecksumAlgorithm: algorithm.Name,
+	}
+	if err := h.openNewUpload(file, state, algorithm); err != nil {
+		// Without its state nothing refers to the file entry, so it would never be cleaned up.
+		if err := deleteUpload(h.db, h.mcfsRoot, file, state); err != nil {
+			log.Errorf("Failed to remove file entry %d for %s: %s", file.ID, path, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// openNewUpload creates the file that a new upload is written to and saves the upload's state.
+func (h *FileTransferHandler) openNewUpload(file *mcmodel.File, state *uploadState, algorithm ChecksumAlgorithm) error {
 	dirPath := file.ToUnderlyingDirPath(h.mcfsRoot)
 	if err := os.MkdirAll(dirPath, 0777); err != nil {
-		log.Errorf("Unable to create directory path %s to store file %s: %s", dirPath, name, err)
+		log.Errorf("Unable to create directory path %s to store file %s: %s", dirPath, file.Name, err)
 		return err
 	}
 
-	h.File = file
-	h.f, err = os.Create(file.ToUnderlyingFilePath(h.mcfsRoot))
+	f, err := os.Create(file.ToUnderlyingFilePath(h.mcfsRoot))
 	if err != nil {
 		log.Errorf("Unable to create file: %s", err)
+		return err
+	}
+
+	hasher := algorithm.New()
+	if err := state.save(h.mcfsRoot, hasher); err != nil {
+		log.Errorf("Failed saving upload state for %s: %s", state.Path, err)
+		_ = f.Close()
+		return err
 	}
 
-	return err
+	h.File = file
+	h.f = f
+	h.hasher = hasher
+	h.upload = state
+
+	return nil
+}
+
+// checkUploadRequest checks that the upload can go ahead, before anything is written to disk or to the
+// database, returning the cleaned path and the checksum algorithm to use.
+func (h *FileTransferHandler) checkUploadRequest(uploadReq *protocol.UploadFileRequest) (string, ChecksumAlgorithm, error) {
+	algorithm, err := LookupChecksumAlgorithm(uploadReq.ChecksumAlgorithm)
+	if err != nil {
+		return "", ChecksumAlgorithm{}, err
+	}
+
+	path, err := cleanUploadPath(uploadReq.Path)
+	if err != nil {
+		return "", ChecksumAlgorithm{}, err
+	}
+
+	if err := h.checkWriteAllowed(path); err != nil {
+		return "", ChecksumAlgorithm{}, err
+	}
+
+	if err := h.checkUploadSize(uploadReq.Size); err != nil {
+		return "", ChecksumAlgorithm{}, err
+	}
+
+	return path, algorithm, nil
+}
+
+// createFileEntry creates the file entry for a new version of the file at path, creating its directory
+// if needed. The entry doesn't become the current version until the file's metadata is updated.
+func (h *FileTransferHandler) createFileEntry(path string) (*mcmodel.File, error) {
+	dir, err := h.getOrCreateDirectory(filepath.Dir(path))
+	if err != nil {
+		log.Errorf("getOrCreateDirectory failed for %s: %s", filepath.Dir(path), err)
+		return nil, err
+	}
+
+	name := filepath.Base(path)
+	file, err := h.fileStore.CreateFile(name, h.Project.ID, dir.ID, h.User.ID, getMimeType(name))
+	if err != nil {
+		log.Errorf("CreateFile failed: %s", err)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// resumeUploadFile picks up a previously interrupted upload to path. The client must be resuming from
+// the offset, and with the checksum algorithm, that the server has recorded, which it gets by sending
+// a FileInfoReq.
+func (h *FileTransferHandler) resumeUploadFile(path string, offset int64, algorithm ChecksumAlgorithm) error {
+	state, err := loadUploadState(h.mcfsRoot, h.Project.ID, path)
+	if err != nil {
+		return err
+	}
+
+	if state.UserID != h.User.ID {
+		return ErrNoUploadToResume
+	}
+
+	if state.Offset != offset {
+		return ErrUnexpectedOffset
+	}
+
+	if stateAlgorithm, _ := LookupChecksumAlgorithm(state.ChecksumAlgorithm); stateAlgorithm.Name != algorithm.Name {
+		return fmt.Errorf("upload was started with checksum algorithm %s", stateAlgorithm.Name)
+	}
+
+	var file mcmodel.File
+	if err := h.db.First(&file, state.FileID).Error; err != nil {
+		log.Errorf("Unable to find file %d to resume upload of %s: %s", state.FileID, path, err)
+		return err
+	}
+
+	hasher, err := state.restoreHasher(file.ToUnderlyingFilePath(h.mcfsRoot))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file.ToUnderlyingFilePath(h.mcfsRoot), os.O_WRONLY, 0)
+	if err != nil {
+		log.Errorf("Unable to open file to resume upload: %s", err)
+		return err
+	}
+
+	// Anything past the offset was written after the state was last saved, so throw it away.
+	if err := f.Truncate(offset); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	h.File = &file
+	h.f = f
+	h.hasher = hasher
+	h.upload = state
+
+	return nil
+}
+
+// pauseUpload suspends the current upload. The file is flushed and closed and its state saved, but it
+// isn't finalized, so a later session can resume it with a FileInfoReq followed by an UploadFileReq.
+func (h *FileTransferHandler) pauseUpload() error {
+	var pauseReq protocol.PauseUploadRequest
+	if err := h.ws.ReadJSON(&pauseReq); err != nil {
+		log.Errorf("Expected pause msg, got err: %s", err)
+		return err
+	}
+
+	if h.f == nil {
+		return ErrBadProtocolSequence
+	}
+
+	return h.suspendUpload()
+}
+
+// suspendUpload flushes and closes the file being uploaded and saves its state, so that the upload can be
+// resumed by a later session.
+func (h *FileTransferHandler) suspendUpload() error {
+	if err := h.f.Sync(); err != nil {
+		log.Errorf("Failed syncing file: %s", err)
+		return err
+	}
+
+	if err := h.f.Close(); err != nil {
+		log.Errorf("Failed closing file: %s", err)
+		return err
+	}
+
+	if err := h.upload.save(h.mcfsRoot, h.hasher); err != nil {
+		log.Errorf("Failed saving upload state for %s: %s", h.upload.Path, err)
+		return err
+	}
+
+	h.audit(h.uploadAuditRecord(auditPauseUpload), nil)
+	h.resetUpload()
+
+	return nil
+}
+
+// discardPartialUpload removes the file, file entry and state for an interrupted upload to path, whether
+// or not it has expired. It only returns nil once there is no state for path, so that a new upload never
+// replaces the state of an upload whose file is still around. An upload another user can still resume
+// is left alone and ErrUploadInProgress is returned.
+func (h *FileTransferHandler) discardPartialUpload(path string) error {
+	state, err := readUploadState(uploadStatePath(h.mcfsRoot, h.Project.ID, path))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		log.Errorf("Unable to read upload state for %s: %s", path, err)
+		return err
+	case state.UserID != h.User.ID && !state.expired():
+		// The other user can still resume it.
+		return ErrUploadInProgress
+	}
+
+	if err := removeUpload(h.db, h.mcfsRoot, state); err != nil {
+		log.Errorf("Failed to discard partial upload of %s: %s", path, err)
+		return err
+	}
+
+	return nil
+}
+
+// abortUpload throws away the current upload rather than finalizing it.
+func (h *FileTransferHandler) abortUpload() {
+	_ = h.f.Close()
+	if err := deleteUpload(h.db, h.mcfsRoot, h.File, h.upload); err != nil {
+		log.Errorf("Failed to delete aborted upload of %s: %s", h.upload.Path, err)
+	}
+	h.resetUpload()
+}
+
+// deleteUpload removes the physical file, the file entry and the saved state for an upload that is never
+// going to be finished. The file entry doesn't become the current version of the file until the upload is
+// finalized, so removing it leaves the project as it was before the upload started. The state is only
+// removed once the file and its entry are gone, so that the sweeper can still find an upload that
+// couldn't be removed.
+func deleteUpload(db *gorm.DB, mcfsRoot string, file *mcmodel.File, state *uploadState) error {
+	if err := os.Remove(file.ToUnderlyingFilePath(mcfsRoot)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := db.Delete(file).Error; err != nil {
+		return err
+	}
+
+	return state.remove(mcfsRoot)
+}
+
+// fileInfo answers a FileInfoReq. It tells the client how much of an interrupted upload to the path
+// the server has, along with the checksum of those bytes so that the client can check they match what
+// it has locally before resuming. If there is no upload to resume the offset is 0.
+func (h *FileTransferHandler) fileInfo() error {
+	var fileInfoReq protocol.FileInfoRequest
+	if err := h.ws.ReadJSON(&fileInfoReq); err != nil {
+		log.Errorf("Expected file info msg, got err: %s", err)
+		return err
+	}
+
+	path, err := cleanProjectPath(fileInfoReq.Path)
+	if err != nil {
+		return err
+	}
+
+	resp := protocol.FileInfoResponse{ChecksumAlgorithm: DefaultChecksumAlgorithm}
+	state, err := loadUploadState(h.mcfsRoot, h.Project.ID, path)
+	var file mcmodel.File
+	if err == nil && state.UserID == h.User.ID && h.db.First(&file, state.FileID).Error == nil {
+		hasher, err := state.restoreHasher(file.ToUnderlyingFilePath(h.mcfsRoot))
+		if err != nil {
+			return err
+		}
+		algorithm, _ := LookupChecksumAlgorithm(state.ChecksumAlgorithm)
+		resp.UploadOffset = state.Offset
+		resp.CurrentChecksum = fmt.Sprintf("%x", hasher.Sum(nil))
+		resp.ChecksumAlgorithm = algorithm.Name
+		resp.ExpiresAt = state.ExpiresAt
+	}
+
+	return h.writeResponse(path, resp)
+}
+
+// writeResponse is used by requests that return data. It writes a StatusResponse followed by the
+// data, so that the client can check the status before reading the data.
+func (h *FileTransferHandler) writeResponse(path string, resp interface{}) error {
+	if err := h.ws.WriteJSON(protocol.StatusResponse{Path: path, Status: "continue"}); err != nil {
+		return err
+	}
+
+	return h.ws.WriteJSON(resp)
 }
 
 func (h *FileTransferHandler) getOrCreateDirectory(dirPath string) (*mcmodel.File, error) {
@@ -225,28 +676,86 @@ func (h *FileTransferHandler) writeFileBlock() error {
 
 	var fileBlockReq protocol.FileBlockRequest
 
-	if err := h.ws.ReadJSON(&fileBlockReq); err != nil {
+	if err := protocol.ReadFileBlock(h.ws, &fileBlockReq, &h.blockBuf, MaxBlockSize); err != nil {
 		log.Errorf("Expected FileBlock msg, got err: %s", err)
 		return err
 	}
 
+	if int64(len(fileBlockReq.Block)) > MaxBlockSize {
+		log.Errorf("Block for %s is %d bytes, larger than max block size %d", h.upload.Path, len(fileBlockReq.Block), MaxBlockSize)
+		return protocol.ErrBlockTooLarge
+	}
+
+	// Older clients don't set the offset, so only check it when it is given.
+	if fileBlockReq.UploadOffset != 0 && fileBlockReq.UploadOffset != h.upload.Offset {
+		log.Errorf("Block for %s at offset %d, expected offset %d", h.upload.Path, fileBlockReq.UploadOffset, h.upload.Offset)
+		return ErrUnexpectedOffset
+	}
+
+	// The declared size was checked when the upload started, but the client may send more than it declared.
+	if err := h.checkBlockSize(int64(len(fileBlockReq.Block))); err != nil {
+		log.Errorf("Block for %s at offset %d exceeds limits, discarding upload: %s", h.upload.Path, h.upload.Offset, err)
+		h.audit(h.uploadAuditRecord(auditUpload), err)
+		h.abortUpload()
+		return err
+	}
+
+	// Check the block before writing it, so that if it was corrupted the client can resend it.
+	if fileBlockReq.Checksum != "" {
+		if err := verifyBlockChecksum(&fileBlockReq); err != nil {
+			log.Errorf("Block for %s at offset %d failed verification: %s", h.upload.Path, h.upload.Offset, err)
+			return err
+		}
+	}
+
 	// TODO: Put write into a loop to make sure we write all the blocks...
 	n, err := h.f.Write(fileBlockReq.Block)
 	if err != nil {
 		log.Errorf("Failed writing to file: %s", err)
+		return err
+	}
+
+	if n != len(fileBlockReq.Block) {
+		log.Errorf("Did not write all of block, wrote %d, length %d", n, len(fileBlockReq.Block))
+		return errors.New("not all bytes written to file")
 	}
 
 	// Compute checksum as we go
 	_, _ = io.Copy(h.hasher, bytes.NewBuffer(fileBlockReq.Block))
 
-	if n != len(fileBlockReq.Block) {
-		log.Errorf("Did not write all of block, wrote %d, length %d", n, len(fileBlockReq.Block))
-		err = errors.New("not all bytes written to file")
+	// Make sure the block is on disk before recording that it was written.
+	if err := h.f.Sync(); err != nil {
+		log.Errorf("Failed syncing file: %s", err)
+		return err
 	}
 
-	return err
+	h.upload.Offset += int64(n)
+	observeBlockReceived(h.Project.ID, n)
+	h.status.progressed(h.upload.Offset)
+	if err := h.upload.save(h.mcfsRoot, h.hasher); err != nil {
+		log.Errorf("Failed saving upload state for %s: %s", h.upload.Path, err)
+		return err
+	}
+
+	return nil
 }
 
+// verifyBlockChecksum checks the block against the checksum the client computed for it.
+func verifyBlockChecksum(fileBlockReq *protocol.FileBlockRequest) error {
+	algorithm, err := LookupChecksumAlgorithm(fileBlockReq.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	if algorithm.Checksum(fileBlockReq.Block) != fileBlockReq.Checksum {
+		checksumMismatches.WithLabelValues("block").Inc()
+		return protocol.ErrBlockChecksumMismatch
+	}
+
+	return nil
+}
+
+// CreateDirectoryAll creates dir and any of its parents that don't exist. dir must be a clean path.
 func (h *FileTransferHandler) CreateDirectoryAll(dir string) (*mcmodel.File, error) {
 	dirs := strings.Split(dir, "/")
 	pathToCheck := "/"
@@ -258,6 +767,11 @@ func (h *FileTransferHandler) CreateDirectoryAll(dir string) (*mcmodel.File, err
 	}
 
 	for _, dirName := range dirs {
+		if dirName == "" {
+			// The leading "/", which is the root directory found above.
+			continue
+		}
+
 		pathToCheck = filepath.Join(pathToCheck, dirName)
 		dirEntry, err := h.fileStore.CreateDirIfNotExists(parentDir.ID, pathToCheck, dirName, h.Project.ID, h.User.ID)
 		if err != nil {
@@ -290,30 +804,98 @@ func (h *FileTransferHandler) fileNeedsConverting() bool {
 func (h *FileTransferHandler) submitConversionJobOnFile() {
 	if _, err := h.convStore.AddFileToConvert(h.File); err != nil {
 		log.Errorf("Unable to submit conversion on file (%d)(%s): %s", h.File.ID, h.File.Name, err)
+		return
 	}
+	conversionJobsSubmitted.Inc()
 }
 
-func (h *FileTransferHandler) computeAndValidateChecksum() error {
-	var (
-		finishUploadRequest protocol.FinishUploadRequest
-		statusResponse      protocol.StatusResponse
-	)
+// finishUpload handles a FinishUploadReq. It checks the checksum the client computed against the one
+// computed as the blocks were written. If they match the uploaded file is finalized. If they don't then
+// the upload is thrown away so that the corrupt file never becomes the current version, and the client
+// has to upload the file again. Once the upload is finished the session can be used to upload another file.
+func (h *FileTransferHandler) finishUpload() error {
+	var finishUploadRequest protocol.FinishUploadRequest
 
 	if err := h.ws.ReadJSON(&finishUploadRequest); err != nil {
 		return err
 	}
 
+	if h.f == nil {
+		return ErrBadProtocolSequence
+	}
+
 	checksum := fmt.Sprintf("%x", h.hasher.Sum(nil))
+	record := h.uploadAuditRecord(auditUpload)
 
 	if checksum != finishUploadRequest.FileChecksum {
-		statusResponse.Status = fmt.Sprintf("checksums didn't match got (%s), expected (%s)", checksum, finishUploadRequest.FileChecksum)
-		statusResponse.IsError = true
-	} else {
-		statusResponse.Status = "checksums matched!"
-		statusResponse.IsError = false
+		log.Errorf("Checksum mismatch for %s, discarding upload of file %d", h.upload.Path, h.File.ID)
+		checksumMismatches.WithLabelValues("file").Inc()
+		h.abortUpload()
+		err := fmt.Errorf("%w got (%s), expected (%s)", ErrChecksumMismatch, checksum, finishUploadRequest.FileChecksum)
+		h.audit(record, err)
+		return err
+	}
+
+	record.Checksum, record.Dedup = h.finalizeUpload(checksum)
+	observeSince(uploadDuration, h.uploadStarted)
+	h.audit(record, nil)
+
+	return nil
+}
+
+// finalizeUpload closes the uploaded file and updates its metadata. If the contents match an existing
+// upload then the file is pointed at it, otherwise a conversion is submitted if the file type needs one.
+// It returns the checksum as stored with the file, and whether the contents were new or already existed.
+func (h *FileTransferHandler) finalizeUpload(checksum string) (storedChecksum, dedup string) {
+	defer h.resetUpload()
+
+	_ = h.f.Close()
+
+	if err := h.upload.remove(h.mcfsRoot); err != nil {
+		log.Errorf("Failed to remove upload state for %s: %s", h.upload.Path, err)
+	}
+
+	// The algorithm is stored with the checksum so that an existing upload is only matched
+	// when its checksum was computed with the same algorithm.
+	algorithm, _ := LookupChecksumAlgorithm(h.upload.ChecksumAlgorithm)
+	storedChecksum = StoredChecksum(algorithm.Name, checksum)
+
+	finfo, err := os.Stat(h.File.ToUnderlyingFilePath(h.mcfsRoot))
+	if err == nil {
+		if err := h.fileStore.UpdateMetadataForFileAndProject(h.File, storedChecksum, h.Project.ID, finfo.Size()); err != nil {
+			log.Errorf("Failed to update metadata for file %d: %s", h.File.ID, err)
+		}
+		h.File.Checksum = storedChecksum
 	}
 
-	return h.ws.WriteJSON(statusResponse)
+	if algorithm.Dedup && h.pointedAtExistingFile() {
+		// There is already an uploaded that matches the checksum. At this point the file entry has been updated
+		// to point at it, so we can remove the physical file that was uploaded. Not that we are deleting the file
+		// pointed at by h.File.UUID. At this point h.File.UsesUUID has been updated, so we explicitly need to
+		// remove the file that was just uploaded (which went into a path determined by h.File.UUID).
+		if err := os.Remove(h.File.ToUnderlyingFilePathForUUID(h.mcfsRoot)); err != nil {
+			log.Errorf("Failed to remove file %s: %s", h.File.ToUnderlyingFilePathForUUID(h.mcfsRoot), err)
+		}
+		return storedChecksum, dedupExisting
+	}
+
+	// If we are here then this is a new file without a checksum match in the database. Check to see if
+	// we should create a converted version for viewing on the web.
+	if h.fileNeedsConverting() {
+		// Kick off a job to do a conversion
+		h.submitConversionJobOnFile()
+	}
+
+	return storedChecksum, dedupNew
+}
+
+// resetUpload clears the state for the current upload so that the session is ready for the next one.
+func (h *FileTransferHandler) resetUpload() {
+	h.f = nil
+	h.File = nil
+	h.upload = nil
+	h.hasher = nil
+	h.status.transferDone()
 }
 
 func (h *FileTransferHandler) pointedAtExistingFile() bool {
@@ -321,6 +903,9 @@ func (h *FileTransferHandler) pointedAtExistingFile() bool {
 	if err != nil {
 		return false
 	}
+	if switched {
+		dedupHits.WithLabelValues("after_upload").Inc()
+	}
 	return switched
 }
 
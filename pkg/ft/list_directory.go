@@ -0,0 +1,112 @@
+package ft
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+// listDirectoryRequest handles a ListDirectoryReq. The response is a StatusResponse, followed (if there
+// was no error) by a ListDirectoryResponse. Listing a file returns a response containing only the file,
+// so clients can use a listing to check whether a file is already on the server.
+func (h *FileTransferHandler) listDirectoryRequest() error {
+	var listReq protocol.ListDirectoryRequest
+	if err := h.ws.ReadJSON(&listReq); err != nil {
+		log.Errorf("Expected list directory msg, got err: %s", err)
+		return err
+	}
+
+	path, err := cleanProjectPath(listReq.Path)
+	if err != nil {
+		return err
+	}
+
+	file, err := h.findFileOrDirByPath(path)
+	if err != nil {
+		return err
+	}
+
+	entries := []protocol.FileInfo{toFileInfo(file)}
+	if file.IsDir() {
+		if entries, err = h.listDirectory(path, file); err != nil {
+			log.Errorf("Unable to list directory %s: %s", path, err)
+			return err
+		}
+	}
+
+	return h.writeResponse(path, protocol.ListDirectoryResponse{
+		Path:    path,
+		Status:  "ok",
+		IsDir:   file.IsDir(),
+		Files:   entries,
+		Version: protocol.NewVersion(protocol.CurrentVersion),
+	})
+}
+
+// listDirectory returns the entries in dir, which is at dirPath. Files that have a current version are
+// listed as complete, and interrupted uploads of files that don't are listed as incomplete.
+func (h *FileTransferHandler) listDirectory(dirPath string, dir *mcmodel.File) ([]protocol.FileInfo, error) {
+	var files []mcmodel.File
+	err := h.db.Where("directory_id = ?", dir.ID).
+		Where("project_id = ?", h.Project.ID).
+		Where("current = ? OR mime_type = ?", true, "directory").
+		Order("name").
+		Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]protocol.FileInfo, 0, len(files))
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		entries = append(entries, toFileInfo(&file))
+		names[file.Name] = true
+	}
+
+	for _, partial := range h.partialUploads(dirPath) {
+		if !names[partial.Name] {
+			entries = append(entries, partial)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries, nil
+}
+
+// partialUploads returns an incomplete entry for each interrupted upload into the directory at dirPath
+// that can still be resumed. The size is how much of the file the server has.
+func (h *FileTransferHandler) partialUploads(dirPath string) []protocol.FileInfo {
+	statePaths, err := filepath.Glob(filepath.Join(uploadStateDir(h.mcfsRoot, h.Project.ID), "*.json"))
+	if err != nil {
+		return nil
+	}
+
+	var partials []protocol.FileInfo
+	for _, statePath := range statePaths {
+		state, err := readUploadState(statePath)
+		if err != nil || state.expired() || path.Dir(state.Path) != dirPath {
+			continue
+		}
+
+		finfo, err := os.Stat(statePath)
+		if err != nil {
+			continue
+		}
+
+		partials = append(partials, protocol.FileInfo{
+			Name:              path.Base(state.Path),
+			Size:              state.Offset,
+			ChecksumAlgorithm: state.ChecksumAlgorithm,
+			UploadComplete:    false,
+			UpdatedAt:         finfo.ModTime(),
+		})
+	}
+
+	return partials
+}
@@ -0,0 +1,64 @@
+package ft
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics are registered with the default prometheus registry, which mcftservd serves on /metrics.
+var (
+	activeSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mcft_active_sessions",
+		Help: "Number of file transfer sessions currently connected.",
+	})
+
+	bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcft_bytes_received_total",
+		Help: "Bytes of uploaded files written to disk, by project.",
+	}, []string{"project_id"})
+
+	blocksReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mcft_blocks_received_total",
+		Help: "Upload blocks written to disk.",
+	})
+
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mcft_upload_duration_seconds",
+		Help:    "Time from starting or resuming an upload in a session to finishing it.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+	})
+
+	checksumMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcft_checksum_mismatches_total",
+		Help: "Checksum mismatches, for a single block or for a whole file.",
+	}, []string{"kind"})
+
+	dedupHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcft_dedup_hits_total",
+		Help: "Files whose contents matched an existing upload, after uploading or when the checksum was offered.",
+	}, []string{"stage"})
+
+	conversionJobsSubmitted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mcft_conversion_jobs_submitted_total",
+		Help: "Conversion jobs submitted for uploaded files.",
+	})
+
+	projectMutexWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mcft_project_mutex_wait_seconds",
+		Help:    "Time spent waiting to acquire a project mutex.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
+
+// observeBlockReceived records a block of n bytes being written for an upload to the project.
+func observeBlockReceived(projectID int, n int) {
+	bytesReceived.WithLabelValues(strconv.Itoa(projectID)).Add(float64(n))
+	blocksReceived.Inc()
+}
+
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
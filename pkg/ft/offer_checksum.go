@@ -0,0 +1,122 @@
+package ft
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+// offerChecksum handles an OfferChecksumReq, which lets a client skip uploading a file whose contents are
+// already in the project. Only files in the session's project are matched, so that knowing the checksum
+// of a file is never enough to get a copy of a file in a project the user can't access. The new file
+// entry points at the existing contents, the same way a file is deduped after it has been uploaded.
+func (h *FileTransferHandler) offerChecksum() error {
+	var req protocol.OfferChecksumRequest
+	if err := h.ws.ReadJSON(&req); err != nil {
+		log.Errorf("Expected offer checksum msg, got err: %s", err)
+		return err
+	}
+
+	if h.f != nil {
+		return ErrBadProtocolSequence
+	}
+
+	path, err := cleanUploadPath(req.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := h.checkWriteAllowed(path); err != nil {
+		return err
+	}
+
+	algorithm, err := LookupChecksumAlgorithm(req.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	resp := protocol.OfferChecksumResponse{Version: protocol.NewVersion(protocol.CurrentVersion)}
+	if req.Checksum == "" || !algorithm.Dedup {
+		return h.writeResponse(path, resp)
+	}
+
+	storedChecksum := StoredChecksum(algorithm.Name, req.Checksum)
+	existing, ok := h.findExistingContents(storedChecksum, req.Size)
+	if !ok {
+		return h.writeResponse(path, resp)
+	}
+
+	// The new entry counts towards the limits just as an uploaded file would.
+	if err := h.checkUploadSize(req.Size); err != nil {
+		return err
+	}
+
+	// The file is complete, so any partial upload to the path is no longer needed, unless another
+	// session is still working on it.
+	if err := claimUpload(h, path); err != nil {
+		return err
+	}
+	defer h.status.transferDone()
+
+	if err := h.discardPartialUpload(path); err != nil {
+		return err
+	}
+
+	file, err := h.createFileEntry(path)
+	if err != nil {
+		return err
+	}
+
+	// Point at the upload that holds the contents, rather than at a file that itself points at it.
+	usesUUID, usesID := existing.UUID, existing.ID
+	if existing.UsesUUID != "" {
+		usesUUID, usesID = existing.UsesUUID, existing.UsesID
+	}
+
+	err = h.db.Model(file).Updates(map[string]interface{}{"uses_uuid": usesUUID, "uses_id": usesID}).Error
+	if err != nil {
+		log.Errorf("Failed to point file %d at existing contents %s: %s", file.ID, usesUUID, err)
+		return err
+	}
+	file.UsesUUID, file.UsesID = usesUUID, usesID
+
+	if err := h.fileStore.UpdateMetadataForFileAndProject(file, storedChecksum, h.Project.ID, req.Size); err != nil {
+		log.Errorf("Failed to update metadata for file %d: %s", file.ID, err)
+		return err
+	}
+
+	dedupHits.WithLabelValues("offer").Inc()
+	h.audit(auditRecord{
+		Action:   auditOfferChecksum,
+		Path:     path,
+		FileID:   file.ID,
+		Bytes:    req.Size,
+		Checksum: storedChecksum,
+		Dedup:    dedupExisting,
+	}, nil)
+	resp.Uploaded = true
+	return h.writeResponse(path, resp)
+}
+
+// findExistingContents looks for a file in the project with the checksum and size whose contents are
+// still on disk.
+func (h *FileTransferHandler) findExistingContents(storedChecksum string, size int64) (*mcmodel.File, bool) {
+	var existing mcmodel.File
+	err := h.db.Where("project_id = ?", h.Project.ID).
+		Where("checksum = ?", storedChecksum).
+		Where("size = ?", size).
+		Where("mime_type <> ?", "directory").
+		First(&existing).Error
+	if err != nil {
+		return nil, false
+	}
+
+	finfo, err := os.Stat(existing.ToUnderlyingFilePath(h.mcfsRoot))
+	if err != nil || finfo.Size() != size {
+		return nil, false
+	}
+
+	return &existing, true
+}
@@ -0,0 +1,67 @@
+package ft
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// maxPathSegmentLength is the longest name a file or directory in a project can have.
+const maxPathSegmentLength = 255
+
+var ErrInvalidPath = errors.New("invalid path")
+var ErrPathNotAllowed = errors.New("path not allowed")
+
+// cleanProjectPath validates a path in a project sent by a client, and returns it in normal form: absolute,
+// with no empty or "." segments and no trailing slash. Paths that try to leave their directory with "..",
+// or that contain control characters or backslashes, are rejected rather than cleaned, since they are far
+// more likely to be a mistake, or an attack, than a path the user meant.
+func cleanProjectPath(p string) (string, error) {
+	if strings.TrimSpace(p) == "" {
+		return "", fmt.Errorf("%w: empty path", ErrInvalidPath)
+	}
+
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%w: %q contains '..'", ErrInvalidPath, p)
+		}
+
+		if len(segment) > maxPathSegmentLength {
+			return "", fmt.Errorf("%w: %q has a name longer than %d characters", ErrInvalidPath, p, maxPathSegmentLength)
+		}
+	}
+
+	for _, r := range p {
+		if r == '\\' || unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return "", fmt.Errorf("%w: %q contains %q", ErrInvalidPath, p, r)
+		}
+	}
+
+	return path.Clean("/" + p), nil
+}
+
+// cleanUploadPath is cleanProjectPath for a path being written to. The root of the project isn't a file,
+// so it can't be uploaded to.
+func cleanUploadPath(p string) (string, error) {
+	cleaned, err := cleanProjectPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	if cleaned == "/" {
+		return "", fmt.Errorf("%w: can't upload to the project root", ErrInvalidPath)
+	}
+
+	return cleaned, nil
+}
+
+// pathIsUnder returns true if p is prefix or is inside the directory prefix. Both must be clean.
+func pathIsUnder(p, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
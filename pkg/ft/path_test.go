@@ -0,0 +1,139 @@
+package ft
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCleanProjectPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "absolute", path: "/raw/data.csv", want: "/raw/data.csv"},
+		{name: "relative", path: "raw/data.csv", want: "/raw/data.csv"},
+		{name: "root", path: "/", want: "/"},
+		{name: "empty segments", path: "//raw///data.csv", want: "/raw/data.csv"},
+		{name: "dot segments", path: "/raw/./data.csv", want: "/raw/data.csv"},
+		{name: "trailing slash", path: "/raw/", want: "/raw"},
+		{name: "dots in name", path: "/raw/..data", want: "/raw/..data"},
+		{name: "unicode name", path: "/raw/données.csv", want: "/raw/données.csv"},
+		{name: "empty", path: "", wantErr: true},
+		{name: "blank", path: "   ", wantErr: true},
+		{name: "parent", path: "/raw/../etc/passwd", wantErr: true},
+		{name: "leading parent", path: "../data.csv", wantErr: true},
+		{name: "only parent", path: "..", wantErr: true},
+		{name: "trailing parent", path: "/raw/..", wantErr: true},
+		{name: "backslash", path: `/raw\data.csv`, wantErr: true},
+		{name: "backslash parent", path: `/raw/..\..\data.csv`, wantErr: true},
+		{name: "newline", path: "/raw/data\n.csv", wantErr: true},
+		{name: "nul", path: "/raw/data\x00.csv", wantErr: true},
+		{name: "delete", path: "/raw/data\x7f.csv", wantErr: true},
+		{name: "invalid utf8", path: "/raw/data\xff.csv", wantErr: true},
+		{name: "long name", path: "/raw/" + strings.Repeat("a", maxPathSegmentLength+1), wantErr: true},
+		{name: "longest name", path: "/raw/" + strings.Repeat("a", maxPathSegmentLength), want: "/raw/" + strings.Repeat("a", maxPathSegmentLength)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := cleanProjectPath(test.path)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidPath) {
+					t.Fatalf("cleanProjectPath(%q) = %q, %v, want ErrInvalidPath", test.path, got, err)
+				}
+				return
+			}
+
+			if err != nil || got != test.want {
+				t.Fatalf("cleanProjectPath(%q) = %q, %v, want %q", test.path, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestCleanUploadPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/raw/data.csv", want: "/raw/data.csv"},
+		{path: "data.csv", want: "/data.csv"},
+		{path: "/", wantErr: true},
+		{path: "//", wantErr: true},
+		{path: "/.", wantErr: true},
+		{path: "/raw/../data.csv", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := cleanUploadPath(test.path)
+		if test.wantErr {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("cleanUploadPath(%q) = %q, %v, want ErrInvalidPath", test.path, got, err)
+			}
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("cleanUploadPath(%q) = %q, %v, want %q", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestPathIsUnder(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{path: "/raw/instrument-3", prefix: "/raw/instrument-3", want: true},
+		{path: "/raw/instrument-3/run1/data.csv", prefix: "/raw/instrument-3", want: true},
+		{path: "/raw/instrument-30", prefix: "/raw/instrument-3", want: false},
+		{path: "/raw/instrument-30/data.csv", prefix: "/raw/instrument-3", want: false},
+		{path: "/raw/instrument-3.csv", prefix: "/raw/instrument-3", want: false},
+		{path: "/raw", prefix: "/raw/instrument-3", want: false},
+		{path: "/processed/instrument-3", prefix: "/raw/instrument-3", want: false},
+		{path: "/anything/at/all", prefix: "/", want: true},
+		{path: "/", prefix: "/", want: true},
+	}
+
+	for _, test := range tests {
+		if got := pathIsUnder(test.path, test.prefix); got != test.want {
+			t.Errorf("pathIsUnder(%q, %q) = %t, want %t", test.path, test.prefix, got, test.want)
+		}
+	}
+}
+
+// TestCheckWriteAllowed checks that a path cleaned the way uploads clean them can't escape the prefix of a
+// session token.
+func TestCheckWriteAllowed(t *testing.T) {
+	h := &FileTransferHandler{sessionToken: &sessionToken{PathPrefix: "/raw/instrument-3"}}
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{path: "/raw/instrument-3/data.csv", allowed: true},
+		{path: "raw//instrument-3/./data.csv", allowed: true},
+		{path: "/raw/instrument-30/data.csv", allowed: false},
+		{path: "/raw/data.csv", allowed: false},
+	}
+
+	for _, test := range tests {
+		path, err := cleanUploadPath(test.path)
+		if err != nil {
+			t.Fatalf("cleanUploadPath(%q) failed: %s", test.path, err)
+		}
+
+		err = h.checkWriteAllowed(path)
+		if test.allowed && err != nil {
+			t.Errorf("checkWriteAllowed(%q) = %v, want allowed", path, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrPathNotAllowed) {
+			t.Errorf("checkWriteAllowed(%q) = %v, want ErrPathNotAllowed", path, err)
+		}
+	}
+}
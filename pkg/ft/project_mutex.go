@@ -2,6 +2,7 @@ package ft
 
 import (
 	"sync"
+	"time"
 
 	"github.com/apex/log"
 )
@@ -9,20 +10,28 @@ import (
 var mapMutex sync.Mutex
 var mutexes = make(map[int]*sync.Mutex)
 
+// acquireProjectMutex locks the mutex for a project, creating it if needed. The map lock is only held while
+// looking up the project mutex, not while waiting on it, so that a session waiting on one project doesn't
+// block sessions for other projects, or the release of the mutex it is waiting on.
 func acquireProjectMutex(projectID int) {
 	mapMutex.Lock()
-	defer mapMutex.Unlock()
-	var p sync.Mutex
 	projectMutex, ok := mutexes[projectID]
 	if !ok {
-		projectMutex = &p
+		projectMutex = &sync.Mutex{}
 		mutexes[projectID] = projectMutex
 	}
+	mapMutex.Unlock()
+
+	start := time.Now()
 	projectMutex.Lock()
+	observeSince(projectMutexWait, start)
 }
 
 func releaseProjectMutex(projectID int) {
+	mapMutex.Lock()
 	m, ok := mutexes[projectID]
+	mapMutex.Unlock()
+
 	if !ok {
 		log.Errorf("releaseProjectMutex called on project (%d) with no mutex", projectID)
 		return
@@ -0,0 +1,89 @@
+package ft
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// MaxFileSize is the largest file the server accepts. A value of 0 means there is no limit.
+var MaxFileSize int64 = 0
+
+// ProjectQuota is the most bytes the current versions of the files in a project can add up to, and
+// UserQuota the most bytes the current versions of the files a user has uploaded, across all projects,
+// can add up to. A value of 0 means there is no limit.
+var (
+	ProjectQuota int64 = 0
+	UserQuota    int64 = 0
+)
+
+var ErrFileTooLarge = errors.New("file is larger than the server accepts")
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// checkUploadSize checks the size a client declares for a file when it starts uploading it, so that the
+// client finds out about a limit before it sends any of the file.
+func (h *FileTransferHandler) checkUploadSize(size int64) error {
+	if MaxFileSize > 0 && size > MaxFileSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d bytes", ErrFileTooLarge, size, MaxFileSize)
+	}
+
+	return h.checkQuota(size)
+}
+
+// checkBlockSize checks that writing a block of blockSize bytes to the current upload keeps it within
+// the limits. The quota is only checked again once the upload grows past the size that was declared, and
+// checked when the upload started.
+func (h *FileTransferHandler) checkBlockSize(blockSize int64) error {
+	size := h.upload.Offset + blockSize
+	if MaxFileSize > 0 && size > MaxFileSize {
+		return fmt.Errorf("%w: more than %d bytes sent", ErrFileTooLarge, MaxFileSize)
+	}
+
+	if size <= h.upload.Size {
+		return nil
+	}
+
+	return h.checkQuota(size)
+}
+
+// checkQuota returns ErrQuotaExceeded if adding a file of size bytes would take the project or the user
+// over their quota.
+func (h *FileTransferHandler) checkQuota(size int64) error {
+	if ProjectQuota > 0 {
+		used, err := h.bytesUsed("project_id = ?", h.Project.ID)
+		if err != nil {
+			return err
+		}
+
+		if used+size > ProjectQuota {
+			return fmt.Errorf("%w: project is using %d of %d bytes", ErrQuotaExceeded, used, ProjectQuota)
+		}
+	}
+
+	if UserQuota > 0 {
+		used, err := h.bytesUsed("owner_id = ?", h.User.ID)
+		if err != nil {
+			return err
+		}
+
+		if used+size > UserQuota {
+			return fmt.Errorf("%w: user is using %d of %d bytes", ErrQuotaExceeded, used, UserQuota)
+		}
+	}
+
+	return nil
+}
+
+// bytesUsed adds up the size of the current versions of the files matching the query.
+func (h *FileTransferHandler) bytesUsed(query string, arg interface{}) (int64, error) {
+	var used int64
+	err := h.db.Model(&mcmodel.File{}).
+		Where(query, arg).
+		Where("current = ?", true).
+		Where("mime_type <> ?", "directory").
+		Select("COALESCE(SUM(size), 0)").
+		Scan(&used).Error
+
+	return used, err
+}
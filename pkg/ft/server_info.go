@@ -0,0 +1,33 @@
+package ft
+
+import (
+	"github.com/apex/log"
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+// MaxBlockSize is the largest block the server accepts in a FileBlockReq. It is also the size of
+// the blocks sent to the client for downloads.
+var MaxBlockSize int64 = 32 * 1024 * 1024
+
+// serverInfo answers a ServerInfoReq, telling the client the limits and features of the server so
+// that it can adapt how it uploads files.
+func (h *FileTransferHandler) serverInfo() error {
+	var req protocol.ServerInfoRequest
+	if err := h.ws.ReadJSON(&req); err != nil {
+		log.Errorf("Expected server info msg, got err: %s", err)
+		return err
+	}
+
+	resp := protocol.ServerInfoResponse{
+		MaxSize:                 MaxFileSize,
+		MaxBlockSize:            MaxBlockSize,
+		ChecksumAlgorithms:      ChecksumAlgorithmNames(),
+		BlockChecksumsSupported: true,
+		UploadExpirationTime:    int(UploadExpiration.Seconds()),
+		SessionTokensSupported:  true,
+		OfferChecksumSupported:  true,
+		Version:                 protocol.NewVersion(protocol.CurrentVersion),
+	}
+
+	return h.writeResponse("", resp)
+}
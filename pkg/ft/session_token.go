@@ -0,0 +1,167 @@
+package ft
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mcft/pkg/protocol"
+)
+
+// SessionTokenExpiration is the longest a session token is valid for. Clients can ask for a shorter
+// lifetime.
+var SessionTokenExpiration = 12 * time.Hour
+
+var ErrAPITokenRequired = errors.New("request requires authenticating with an API token")
+var ErrInvalidSessionToken = errors.New("invalid or expired session token")
+
+// sessionToken is a short-lived token that a client can authenticate with instead of its API token.
+// It is bound to the user and project it was created for. If PathPrefix is set then sessions using the
+// token can only write under that path, for example so an instrument can only upload to its own directory.
+type sessionToken struct {
+	Token      string
+	UserID     int
+	ProjectID  int
+	PathPrefix string
+	ExpiresAt  time.Time
+}
+
+// sessionTokens holds the tokens that have been handed out. They are only kept in memory, so restarting
+// the server revokes all of them and clients fall back to their API token.
+var sessionTokens = struct {
+	sync.Mutex
+	tokens map[string]*sessionToken
+}{tokens: make(map[string]*sessionToken)}
+
+// newSessionToken creates a token for the user and project, limited to writing under pathPrefix if it
+// isn't empty. The token expires after expiresIn, or after SessionTokenExpiration if expiresIn is 0 or
+// longer than that.
+func newSessionToken(userID, projectID int, pathPrefix string, expiresIn time.Duration) (*sessionToken, error) {
+	if expiresIn <= 0 || expiresIn > SessionTokenExpiration {
+		expiresIn = SessionTokenExpiration
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	token := &sessionToken{
+		Token:      hex.EncodeToString(b),
+		UserID:     userID,
+		ProjectID:  projectID,
+		PathPrefix: pathPrefix,
+		ExpiresAt:  time.Now().Add(expiresIn),
+	}
+
+	sessionTokens.Lock()
+	defer sessionTokens.Unlock()
+
+	// Clients that crash never revoke their tokens, so expired tokens are dropped as new ones are made
+	// rather than being kept for as long as the server runs.
+	pruneExpiredSessionTokens(time.Now())
+	sessionTokens.tokens[token.Token] = token
+
+	return token, nil
+}
+
+// pruneExpiredSessionTokens removes the tokens that have expired by now. The caller must hold the
+// sessionTokens lock.
+func pruneExpiredSessionTokens(now time.Time) {
+	for key, t := range sessionTokens.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(sessionTokens.tokens, key)
+		}
+	}
+}
+
+// lookupSessionToken returns the token, or ErrInvalidSessionToken if it doesn't exist or has expired.
+func lookupSessionToken(token string) (*sessionToken, error) {
+	sessionTokens.Lock()
+	defer sessionTokens.Unlock()
+
+	t, ok := sessionTokens.tokens[token]
+	if !ok {
+		return nil, ErrInvalidSessionToken
+	}
+
+	if time.Now().After(t.ExpiresAt) {
+		delete(sessionTokens.tokens, token)
+		return nil, ErrInvalidSessionToken
+	}
+
+	return t, nil
+}
+
+// revokeSessionToken removes the token if it belongs to the user. It returns false if there was no such
+// token.
+func revokeSessionToken(token string, userID int) bool {
+	sessionTokens.Lock()
+	defer sessionTokens.Unlock()
+
+	t, ok := sessionTokens.tokens[token]
+	if !ok || t.UserID != userID {
+		return false
+	}
+
+	delete(sessionTokens.tokens, token)
+	return true
+}
+
+// createSessionToken handles a CreateSessionTokenReq. Only sessions authenticated with an API token can
+// create session tokens, otherwise a session token could be used to keep itself alive forever.
+func (h *FileTransferHandler) createSessionToken() error {
+	var req protocol.CreateSessionTokenRequest
+	if err := h.ws.ReadJSON(&req); err != nil {
+		log.Errorf("Expected create session token msg, got err: %s", err)
+		return err
+	}
+
+	if h.sessionToken != nil {
+		return ErrAPITokenRequired
+	}
+
+	pathPrefix := ""
+	if req.PathPrefix != "" {
+		var err error
+		if pathPrefix, err = cleanProjectPath(req.PathPrefix); err != nil {
+			return err
+		}
+	}
+
+	token, err := newSessionToken(h.User.ID, h.Project.ID, pathPrefix, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	return h.writeResponse("", protocol.SessionTokenResponse{
+		SessionToken: token.Token,
+		PathPrefix:   token.PathPrefix,
+		ExpiresAt:    token.ExpiresAt,
+		Version:      protocol.NewVersion(protocol.CurrentVersion),
+	})
+}
+
+// revokeSessionToken handles a RevokeSessionTokenReq. An empty token revokes the token the session
+// authenticated with.
+func (h *FileTransferHandler) revokeSessionToken() error {
+	var req protocol.RevokeSessionTokenRequest
+	if err := h.ws.ReadJSON(&req); err != nil {
+		log.Errorf("Expected revoke session token msg, got err: %s", err)
+		return err
+	}
+
+	token := req.SessionToken
+	if token == "" && h.sessionToken != nil {
+		token = h.sessionToken.Token
+	}
+
+	if !revokeSessionToken(token, h.User.ID) {
+		return ErrInvalidSessionToken
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package ft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSessionTokenPrunesExpiredTokens(t *testing.T) {
+	expired, err := newSessionToken(1, 1, "", time.Hour)
+	if err != nil {
+		t.Fatalf("newSessionToken failed: %s", err)
+	}
+	live, err := newSessionToken(1, 1, "", time.Hour)
+	if err != nil {
+		t.Fatalf("newSessionToken failed: %s", err)
+	}
+	defer revokeSessionToken(live.Token, 1)
+
+	sessionTokens.Lock()
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	sessionTokens.Unlock()
+
+	token, err := newSessionToken(1, 1, "", time.Hour)
+	if err != nil {
+		t.Fatalf("newSessionToken failed: %s", err)
+	}
+	defer revokeSessionToken(token.Token, 1)
+
+	sessionTokens.Lock()
+	defer sessionTokens.Unlock()
+	if _, ok := sessionTokens.tokens[expired.Token]; ok {
+		t.Errorf("expired token was kept")
+	}
+	if _, ok := sessionTokens.tokens[live.Token]; !ok {
+		t.Errorf("unexpired token was removed")
+	}
+}
@@ -0,0 +1,258 @@
+package ft
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down, resume the upload once it is back")
+
+// sessions tracks the sessions that are running, so that the server can wait for them to end when it
+// shuts down.
+var sessions = struct {
+	sync.Mutex
+	handlers map[*FileTransferHandler]bool
+	wg       sync.WaitGroup
+}{handlers: make(map[*FileTransferHandler]bool)}
+
+// draining is set, atomically, once the server has started shutting down.
+var draining int32
+
+// IsDraining returns true once DrainSessions has been called and the server is shutting down.
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func registerSession(h *FileTransferHandler) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.handlers[h] = true
+	sessions.wg.Add(1)
+	activeSessions.Inc()
+}
+
+func unregisterSession(h *FileTransferHandler) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.handlers, h)
+	sessions.wg.Done()
+	activeSessions.Dec()
+}
+
+// DrainSessions is called when the server is shutting down, once it has stopped accepting connections.
+// Each session finishes the request it is handling, which for an upload means the block being written is
+// flushed to disk, and then pauses its upload and tells the client the server is shutting down, so that
+// the client can resume the upload later. Sessions without an upload open send the result of the request
+// and end. Sessions that are waiting for a request are ended once timeout
+// has passed. DrainSessions returns false if sessions were still running after the timeout.
+func DrainSessions(timeout time.Duration) bool {
+	atomic.StoreInt32(&draining, 1)
+
+	deadline := time.Now().Add(timeout)
+	sessions.Lock()
+	for h := range sessions.handlers {
+		// Reads that are in progress when the deadline passes fail, which ends the session. The state of
+		// an upload is saved after each block, so the upload can still be resumed from the last block.
+		_ = h.ws.SetReadDeadline(deadline)
+	}
+	sessions.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sessions.wg.Wait()
+		close(done)
+	}()
+
+	// Give sessions a moment after the deadline to clean up.
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout + time.Second):
+		return false
+	}
+}
+
+var ErrSessionCancelled = errors.New("session was cancelled by an administrator")
+
+var ErrUploadInProgress = errors.New("another upload to the path is in progress")
+
+// claimUpload records that the session is uploading to path, unless another session already is. The
+// check and the claim are made under the sessions lock, so two sessions can't both claim a path.
+func claimUpload(h *FileTransferHandler, path string) error {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	for other := range sessions.handlers {
+		if other == h {
+			continue
+		}
+
+		info := other.status.snapshot()
+		if info.Transfer == transferUpload && info.ProjectID == h.Project.ID && info.Path == path {
+			return ErrUploadInProgress
+		}
+	}
+
+	h.status.transferring(transferUpload, path, 0)
+	return nil
+}
+
+// cancelWriteGrace is how long a cancelled session has to finish writing to the client.
+const cancelWriteGrace = 5 * time.Second
+
+// SessionInfo describes a running session for administrators.
+type SessionInfo struct {
+	SessionID   string    `json:"session_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	StartedAt   time.Time `json:"started_at"`
+	UserID      int       `json:"user_id"`
+	UserEmail   string    `json:"user_email"`
+	ProjectID   int       `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+
+	// Transfer is "upload" or "download", or empty if the session isn't transferring a file. Path is the
+	// file being transferred. Bytes is how much of it has been transferred, which for an upload includes
+	// what earlier sessions sent, and BytesPerSecond is how fast it has been transferred in this session.
+	Transfer       string  `json:"transfer,omitempty"`
+	Path           string  `json:"path,omitempty"`
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// sessionStatus is the part of a session's state that administrators can see. Unlike the rest of the
+// handler it is read from outside of the session, so it has its own lock.
+type sessionStatus struct {
+	sync.Mutex
+	info            SessionInfo
+	startBytes      int64
+	transferStarted time.Time
+
+	// token is the session token the session authenticated with, if it used one.
+	token *sessionToken
+
+	// cancelled is set when an administrator cancels the session.
+	cancelled bool
+}
+
+func (s *sessionStatus) authenticated(h *FileTransferHandler) {
+	s.Lock()
+	defer s.Unlock()
+	s.info.UserID = h.User.ID
+	s.info.UserEmail = h.User.Email
+	s.info.ProjectID = h.Project.ID
+	s.info.ProjectName = h.Project.Name
+	s.token = h.sessionToken
+}
+
+// Transfers reported in SessionInfo.
+const (
+	transferUpload   = "upload"
+	transferDownload = "download"
+)
+
+// transferring records that the session has started transferring path, from offset.
+func (s *sessionStatus) transferring(transfer, path string, offset int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.info.Transfer = transfer
+	s.info.Path = path
+	s.info.Bytes = offset
+	s.startBytes = offset
+	s.transferStarted = time.Now()
+}
+
+// progressed records that the transfer has reached offset.
+func (s *sessionStatus) progressed(offset int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.info.Bytes = offset
+}
+
+func (s *sessionStatus) transferDone() {
+	s.transferring("", "", 0)
+}
+
+func (s *sessionStatus) snapshot() SessionInfo {
+	s.Lock()
+	defer s.Unlock()
+
+	info := s.info
+	if info.Transfer != "" {
+		if elapsed := time.Since(s.transferStarted).Seconds(); elapsed > 0 {
+			info.BytesPerSecond = float64(info.Bytes-s.startBytes) / elapsed
+		}
+	}
+
+	return info
+}
+
+func (s *sessionStatus) isCancelled() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.cancelled
+}
+
+// Sessions returns the sessions that are running, oldest first.
+func Sessions() []SessionInfo {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions.handlers))
+	for h := range sessions.handlers {
+		infos = append(infos, h.status.snapshot())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+
+	return infos
+}
+
+// CancelSession cancels the session with the ID. It returns false if there is no such session.
+func CancelSession(sessionID string, revokeToken bool) bool {
+	return cancelSessions(func(info SessionInfo) bool { return info.SessionID == sessionID }, revokeToken) != 0
+}
+
+// CancelProjectSessions cancels all the sessions for the project, returning how many there were.
+func CancelProjectSessions(projectID int, revokeTokens bool) int {
+	return cancelSessions(func(info SessionInfo) bool { return info.ProjectID == projectID }, revokeTokens)
+}
+
+// cancelSessions cancels the sessions that match. A cancelled session is ended by failing its reads, the
+// same way DrainSessions ends sessions, but rather than being left for the client to resume, any upload
+// it was in the middle of is thrown away. A session that is sending a download is ended by failing its
+// writes, after a moment so that it can still tell the client why. If revokeTokens is true then the session token a session
+// authenticated with is revoked, so that the client can't start a new session with it.
+func cancelSessions(match func(info SessionInfo) bool, revokeTokens bool) int {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	count := 0
+	for h := range sessions.handlers {
+		h.status.Lock()
+		matched := match(h.status.info)
+		if matched {
+			h.status.cancelled = true
+		}
+		token := h.status.token
+		h.status.Unlock()
+
+		if !matched {
+			continue
+		}
+
+		if revokeTokens && token != nil {
+			revokeSessionToken(token.Token, token.UserID)
+		}
+
+		_ = h.ws.SetReadDeadline(time.Now())
+		_ = h.ws.SetWriteDeadline(time.Now().Add(cancelWriteGrace))
+		count++
+	}
+
+	return count
+}
@@ -0,0 +1,45 @@
+package ft
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+func TestClaimUpload(t *testing.T) {
+	first := &FileTransferHandler{Project: &mcmodel.Project{ID: 1}}
+	second := &FileTransferHandler{Project: &mcmodel.Project{ID: 1}}
+	otherProject := &FileTransferHandler{Project: &mcmodel.Project{ID: 2}}
+	for _, h := range []*FileTransferHandler{first, second, otherProject} {
+		h.status.info.ProjectID = h.Project.ID
+		registerSession(h)
+		defer unregisterSession(h)
+	}
+
+	if err := claimUpload(first, "/raw/data.csv"); err != nil {
+		t.Fatalf("first claim failed: %s", err)
+	}
+
+	if err := claimUpload(second, "/raw/data.csv"); err != ErrUploadInProgress {
+		t.Fatalf("claim of a path being uploaded = %v, want ErrUploadInProgress", err)
+	}
+
+	if err := claimUpload(second, "/raw/other.csv"); err != nil {
+		t.Fatalf("claim of another path failed: %s", err)
+	}
+	second.status.transferDone()
+
+	if err := claimUpload(otherProject, "/raw/data.csv"); err != nil {
+		t.Fatalf("claim of the path in another project failed: %s", err)
+	}
+
+	// A session can claim the path it is already uploading to, as it does when it resumes.
+	if err := claimUpload(first, "/raw/data.csv"); err != nil {
+		t.Fatalf("claim by the uploading session failed: %s", err)
+	}
+
+	first.status.transferDone()
+	if err := claimUpload(second, "/raw/data.csv"); err != nil {
+		t.Fatalf("claim after the upload finished failed: %s", err)
+	}
+}
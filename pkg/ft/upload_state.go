@@ -0,0 +1,156 @@
+package ft
+
+import (
+	"crypto/md5"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// UploadExpiration is how long an incomplete upload is kept around for the client to resume
+// after its last block was written.
+var UploadExpiration = 7 * 24 * time.Hour
+
+var ErrNoUploadToResume = errors.New("no upload to resume")
+
+// uploadState is the state of an in-progress upload. It is persisted after each block is written so
+// that an upload that is interrupted (for example by a dropped connection) can be resumed from the
+// last block written, rather than starting over.
+type uploadState struct {
+	ProjectID         int       `json:"project_id"`
+	UserID            int       `json:"user_id"`
+	Path              string    `json:"path"`
+	FileID            int       `json:"file_id"`
+	Size              int64     `json:"size"`
+	Offset            int64     `json:"offset"`
+	ChecksumAlgorithm string    `json:"checksum_algorithm"`
+	HasherState       []byte    `json:"hasher_state"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+// uploadStateDir is the directory that upload states are stored in for a project. Each state file is
+// named using the md5 of the project path being uploaded to.
+func uploadStateDir(mcfsRoot string, projectID int) string {
+	return filepath.Join(mcfsRoot, ".mcft", "uploads", strconv.Itoa(projectID))
+}
+
+func uploadStatePath(mcfsRoot string, projectID int, path string) string {
+	name := fmt.Sprintf("%x.json", md5.Sum([]byte(path)))
+	return filepath.Join(uploadStateDir(mcfsRoot, projectID), name)
+}
+
+// loadUploadState returns the saved state for an upload to path in the project. It returns
+// ErrNoUploadToResume if there is no state or the state has expired.
+func loadUploadState(mcfsRoot string, projectID int, path string) (*uploadState, error) {
+	state, err := readUploadState(uploadStatePath(mcfsRoot, projectID, path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoUploadToResume
+		}
+		return nil, err
+	}
+
+	if state.expired() {
+		return nil, ErrNoUploadToResume
+	}
+
+	return state, nil
+}
+
+// readUploadState reads the state file at statePath, whether or not it has expired.
+func readUploadState(statePath string) (*uploadState, error) {
+	contents, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var state uploadState
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func (s *uploadState) expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// save records the state, along with the state of the hasher computing the checksum for the bytes
+// written so far if the hasher is able to save its state. The state is written to a temporary file
+// and renamed so that a crash part way through never leaves a truncated state file behind.
+func (s *uploadState) save(mcfsRoot string, hasher hash.Hash) error {
+	s.HasherState = nil
+	if marshaler, ok := hasher.(encoding.BinaryMarshaler); ok {
+		hasherState, err := marshaler.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		s.HasherState = hasherState
+	}
+
+	s.ExpiresAt = time.Now().Add(UploadExpiration)
+
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(uploadStateDir(mcfsRoot, s.ProjectID), 0777); err != nil {
+		return err
+	}
+
+	statePath := uploadStatePath(mcfsRoot, s.ProjectID, s.Path)
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, contents, 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, statePath)
+}
+
+func (s *uploadState) remove(mcfsRoot string) error {
+	err := os.Remove(uploadStatePath(mcfsRoot, s.ProjectID, s.Path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// restoreHasher returns a hasher that has the state it was in when the upload state was saved. Hashers
+// that can't save their state are rebuilt by reading back the bytes written so far from the partial
+// file at partialPath.
+func (s *uploadState) restoreHasher(partialPath string) (hash.Hash, error) {
+	algorithm, err := LookupChecksumAlgorithm(s.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := algorithm.New()
+	if unmarshaler, ok := hasher.(encoding.BinaryUnmarshaler); ok && len(s.HasherState) != 0 {
+		if err := unmarshaler.UnmarshalBinary(s.HasherState); err != nil {
+			return nil, err
+		}
+		return hasher, nil
+	}
+
+	f, err := os.Open(partialPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(hasher, f, s.Offset); err != nil {
+		return nil, err
+	}
+
+	return hasher, nil
+}
@@ -0,0 +1,132 @@
+package ft
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// ExpiredUpload is a partial upload that has passed its expiration, as found by SweepExpiredUploads.
+type ExpiredUpload struct {
+	ProjectID int       `json:"project_id"`
+	UserID    int       `json:"user_id"`
+	Path      string    `json:"path"`
+	FileID    int       `json:"file_id"`
+	Bytes     int64     `json:"bytes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// sweepMutex keeps the background sweeper and sweeps requested through the admin API from removing the
+// same upload.
+var sweepMutex sync.Mutex
+
+// SweepExpiredUploads finds the partial uploads that have expired, which happens when a client never comes
+// back to resume an upload, and removes their physical files, file entries and state. If dryRun is true
+// then the uploads are only reported and nothing is removed. Uploads that a session in this process is
+// working on are left alone, so SweepExpiredUploads must be called by the server rather than by a
+// separate process.
+func SweepExpiredUploads(db *gorm.DB, mcfsRoot string, dryRun bool) ([]ExpiredUpload, error) {
+	sweepMutex.Lock()
+	defer sweepMutex.Unlock()
+
+	statePaths, err := filepath.Glob(filepath.Join(mcfsRoot, ".mcft", "uploads", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []ExpiredUpload
+	for _, statePath := range statePaths {
+		state, err := readUploadState(statePath)
+		if err != nil {
+			log.Errorf("Unable to read upload state %s: %s", statePath, err)
+			continue
+		}
+
+		if !state.expired() || uploadInProgress(state.ProjectID, state.Path) {
+			continue
+		}
+
+		expired = append(expired, ExpiredUpload{
+			ProjectID: state.ProjectID,
+			UserID:    state.UserID,
+			Path:      state.Path,
+			FileID:    state.FileID,
+			Bytes:     state.Offset,
+			ExpiresAt: state.ExpiresAt,
+		})
+
+		if dryRun {
+			continue
+		}
+
+		if err := removeUpload(db, mcfsRoot, state); err != nil {
+			log.Errorf("Unable to remove expired upload of %s in project %d: %s", state.Path, state.ProjectID, err)
+		}
+	}
+
+	return expired, nil
+}
+
+// removeUpload removes the upload that state is for. If the file entry is missing, or has somehow become
+// the current version of the file, then only the state is removed.
+func removeUpload(db *gorm.DB, mcfsRoot string, state *uploadState) error {
+	var file mcmodel.File
+	err := db.First(&file, state.FileID).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return state.remove(mcfsRoot)
+	case err != nil:
+		return err
+	case file.Current:
+		log.Warnf("Upload state for %s in project %d refers to current file %d, keeping the file", state.Path, state.ProjectID, file.ID)
+		return state.remove(mcfsRoot)
+	}
+
+	return deleteUpload(db, mcfsRoot, &file, state)
+}
+
+// uploadInProgress returns true if a session is uploading to path in the project.
+func uploadInProgress(projectID int, path string) bool {
+	for _, info := range Sessions() {
+		if info.Transfer == transferUpload && info.ProjectID == projectID && info.Path == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RunUploadSweeper calls SweepExpiredUploads every interval until stop is closed, logging what it removes,
+// or with dryRun what it would remove.
+func RunUploadSweeper(db *gorm.DB, mcfsRoot string, interval time.Duration, dryRun bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		expired, err := SweepExpiredUploads(db, mcfsRoot, dryRun)
+		if err != nil {
+			log.Errorf("Sweeping expired uploads failed: %s", err)
+			continue
+		}
+
+		action := "Removed"
+		if dryRun {
+			action = "Would remove"
+		}
+		for _, upload := range expired {
+			log.Infof("%s expired upload of %s in project %d (file %d, %d bytes, expired %s)", action,
+				upload.Path, upload.ProjectID, upload.FileID, upload.Bytes, upload.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+}
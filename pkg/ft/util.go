@@ -1,18 +1,74 @@
 package ft
 
 import (
+	"errors"
 	"os"
 
 	"github.com/materials-commons/mcft/pkg/protocol"
+	"gorm.io/gorm"
 )
 
 const McfsDefault = "/mcfs/data/materialscommons"
 
+// errorCodes maps the errors a request can fail with to the code the client is sent.
+var errorCodes = []struct {
+	err  error
+	code protocol.ErrorCode
+}{
+	{ErrNotAuthenticated, protocol.ErrorCodeNotAuthenticated},
+	{ErrNoProjectAccess, protocol.ErrorCodeNoProjectAccess},
+	{ErrAPITokenRequired, protocol.ErrorCodeNotAuthenticated},
+	{ErrInvalidSessionToken, protocol.ErrorCodeInvalidSessionToken},
+	{ErrAlreadyAuthenticated, protocol.ErrorCodeAlreadyAuthenticated},
+	{ErrBadProtocolSequence, protocol.ErrorCodeBadProtocolSequence},
+	{ErrUnknownRequestType, protocol.ErrorCodeUnknownRequestType},
+	{protocol.ErrBlockTooLarge, protocol.ErrorCodeBlockTooLarge},
+	{protocol.ErrExpectedBinaryBlock, protocol.ErrorCodeBadBlock},
+	{protocol.ErrBlockLengthMismatch, protocol.ErrorCodeBadBlock},
+	{protocol.ErrBlockChecksumMismatch, protocol.ErrorCodeBlockChecksumMismatch},
+	{ErrChecksumMismatch, protocol.ErrorCodeChecksumMismatch},
+	{ErrUnexpectedOffset, protocol.ErrorCodeUnexpectedOffset},
+	{ErrNoUploadToResume, protocol.ErrorCodeNoUploadToResume},
+	{ErrUnsupportedChecksumAlgorithm, protocol.ErrorCodeUnsupportedChecksum},
+	{ErrFileTooLarge, protocol.ErrorCodeFileTooLarge},
+	{ErrQuotaExceeded, protocol.ErrorCodeQuotaExceeded},
+	{ErrShuttingDown, protocol.ErrorCodeServerShuttingDown},
+	{ErrSessionCancelled, protocol.ErrorCodeSessionCancelled},
+	{ErrFileUnavailable, protocol.ErrorCodeFileUnavailable},
+	{ErrUploadInProgress, protocol.ErrorCodeUploadInProgress},
+	{ErrInvalidPath, protocol.ErrorCodeInvalidPath},
+	{ErrPathNotAllowed, protocol.ErrorCodePathNotAllowed},
+	{ErrNotFound, protocol.ErrorCodeNotFound},
+	{gorm.ErrRecordNotFound, protocol.ErrorCodeNotFound},
+}
+
+// Error2Status returns the StatusResponse reporting err to the client. A nil err is reported as
+// success, which tells the client to continue.
 func Error2Status(err error) protocol.StatusResponse {
-	return protocol.StatusResponse{}
+	if err == nil {
+		return protocol.StatusResponse{Status: "continue"}
+	}
+
+	code := protocol.ErrorCodeUnknown
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			code = ec.code
+			break
+		}
+	}
+
+	return protocol.StatusResponse{Status: err.Error(), IsError: true, ErrorCode: code}
 }
 
+// MCFSRoot is the directory uploaded files are stored under. When it isn't set the MCFS_DIR environment
+// variable is used, falling back to McfsDefault.
+var MCFSRoot = ""
+
 func GetMCFSRoot() string {
+	if MCFSRoot != "" {
+		return MCFSRoot
+	}
+
 	root := os.Getenv("MCFS_DIR")
 	if root == "" {
 		return McfsDefault
@@ -0,0 +1,109 @@
+package protocol
+
+import "errors"
+
+// ErrorCode identifies why a request failed, so that clients can act on a failure without parsing
+// the status text. New codes must be added to the end so that existing codes keep their values.
+type ErrorCode int
+
+const (
+	ErrorCodeNone ErrorCode = iota
+	ErrorCodeUnknown
+	ErrorCodeNotAuthenticated
+	ErrorCodeNoProjectAccess
+	ErrorCodeAlreadyAuthenticated
+	ErrorCodeBadProtocolSequence
+	ErrorCodeUnknownRequestType
+	ErrorCodeQuotaExceeded
+	ErrorCodeFileTooLarge
+	ErrorCodeBlockTooLarge
+	ErrorCodeBadBlock
+	ErrorCodeBlockChecksumMismatch
+	ErrorCodeChecksumMismatch
+	ErrorCodeUnexpectedOffset
+	ErrorCodeNoUploadToResume
+	ErrorCodeUnsupportedChecksum
+	ErrorCodeNotFound
+	ErrorCodeInvalidSessionToken
+	ErrorCodeInvalidPath
+	ErrorCodePathNotAllowed
+	ErrorCodeServerShuttingDown
+	ErrorCodeSessionCancelled
+	ErrorCodeFileUnavailable
+	ErrorCodeUploadInProgress
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeNone:                  "none",
+	ErrorCodeUnknown:               "unknown",
+	ErrorCodeNotAuthenticated:      "not-authenticated",
+	ErrorCodeNoProjectAccess:       "no-project-access",
+	ErrorCodeAlreadyAuthenticated:  "already-authenticated",
+	ErrorCodeBadProtocolSequence:   "bad-sequence",
+	ErrorCodeUnknownRequestType:    "unknown-request-type",
+	ErrorCodeQuotaExceeded:         "quota-exceeded",
+	ErrorCodeFileTooLarge:          "file-too-large",
+	ErrorCodeBlockTooLarge:         "block-too-large",
+	ErrorCodeBadBlock:              "bad-block",
+	ErrorCodeBlockChecksumMismatch: "block-checksum-mismatch",
+	ErrorCodeChecksumMismatch:      "checksum-mismatch",
+	ErrorCodeUnexpectedOffset:      "unexpected-offset",
+	ErrorCodeNoUploadToResume:      "no-upload-to-resume",
+	ErrorCodeUnsupportedChecksum:   "unsupported-checksum",
+	ErrorCodeNotFound:              "not-found",
+	ErrorCodeInvalidSessionToken:   "invalid-session-token",
+	ErrorCodeInvalidPath:           "invalid-path",
+	ErrorCodePathNotAllowed:        "path-not-allowed",
+	ErrorCodeServerShuttingDown:    "server-shutting-down",
+	ErrorCodeSessionCancelled:      "session-cancelled",
+	ErrorCodeFileUnavailable:       "file-unavailable",
+	ErrorCodeUploadInProgress:      "upload-in-progress",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+
+	return errorCodeNames[ErrorCodeUnknown]
+}
+
+// StatusError is the error a client gets for a StatusResponse that is an error.
+type StatusError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// Err returns nil if the status isn't an error, otherwise it returns a *StatusError.
+func (s StatusResponse) Err() error {
+	if !s.IsError {
+		return nil
+	}
+
+	code := s.ErrorCode
+	if code == ErrorCodeNone {
+		// Servers from before error codes don't send one.
+		code = ErrorCodeUnknown
+	}
+
+	return &StatusError{Code: code, Message: s.Status}
+}
+
+// ErrorCodeOf returns the code of a *StatusError, ErrorCodeNone if err is nil, and ErrorCodeUnknown
+// for any other error.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ErrorCodeNone
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+
+	return ErrorCodeUnknown
+}
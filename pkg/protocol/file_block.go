@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrExpectedBinaryBlock = errors.New("expected binary message containing block")
+var ErrBlockTooLarge = errors.New("block larger than max block size")
+var ErrBlockLengthMismatch = errors.New("block length does not match content length")
+
+// ErrBlockChecksumMismatch is the status returned when a block's checksum doesn't match the block. Unlike
+// other errors the session isn't closed, and the client can resend the block.
+var ErrBlockChecksumMismatch = errors.New("block checksum mismatch")
+
+// WriteFileBlock sends fb. If fb's version uses binary blocks then fb is sent without the block as the
+// header, and the block is sent as a binary message. Otherwise the block is sent as part of fb.
+func WriteFileBlock(ws *websocket.Conn, fb *FileBlockRequest) error {
+	if !fb.BinaryBlocks() {
+		return ws.WriteJSON(fb)
+	}
+
+	block := fb.Block
+	fb.Block = nil
+	fb.ContentLength = int64(len(block))
+	err := ws.WriteJSON(fb)
+	fb.Block = block
+	if err != nil {
+		return err
+	}
+
+	return ws.WriteMessage(websocket.BinaryMessage, block)
+}
+
+// ReadFileBlock reads a block sent by WriteFileBlock into fb. When the block is sent as a binary message it is
+// read into buf, which can be reused across calls so that a new buffer isn't allocated for each block. A
+// maxSize of 0 means the size of a binary block isn't limited.
+func ReadFileBlock(ws *websocket.Conn, fb *FileBlockRequest, buf *bytes.Buffer, maxSize int64) error {
+	fb.Block = nil
+	if err := ws.ReadJSON(fb); err != nil {
+		return err
+	}
+
+	if !fb.BinaryBlocks() {
+		return nil
+	}
+
+	if maxSize > 0 && fb.ContentLength > maxSize {
+		return ErrBlockTooLarge
+	}
+
+	messageType, r, err := ws.NextReader()
+	if err != nil {
+		return err
+	}
+
+	if messageType != websocket.BinaryMessage {
+		return ErrExpectedBinaryBlock
+	}
+
+	buf.Reset()
+	n, err := buf.ReadFrom(io.LimitReader(r, fb.ContentLength+1))
+	if err != nil {
+		return err
+	}
+
+	if n != fb.ContentLength {
+		return ErrBlockLengthMismatch
+	}
+
+	fb.Block = buf.Bytes()
+
+	return nil
+}
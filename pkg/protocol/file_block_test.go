@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newConnPair returns the two ends of a websocket connection.
+func newConnPair(t *testing.T) (client, server *websocket.Conn) {
+	t.Helper()
+
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %s", err)
+			return
+		}
+		serverConns <- c
+	}))
+	t.Cleanup(s.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	server = <-serverConns
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestFileBlockRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+	}{
+		{name: "json blocks", version: VersionJSONBlocks},
+		{name: "binary blocks", version: VersionBinaryBlocks},
+		{name: "current version", version: CurrentVersion},
+	}
+
+	blocks := [][]byte{
+		[]byte("first block"),
+		bytes.Repeat([]byte{0, 1, 2, 0xff}, 1024),
+		[]byte("last"),
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newConnPair(t)
+
+			go func() {
+				var offset int64
+				for _, block := range blocks {
+					fb := FileBlockRequest{Path: "/data.bin", Block: block, UploadOffset: offset, Version: NewVersion(test.version)}
+					if err := WriteFileBlock(client, &fb); err != nil {
+						t.Errorf("WriteFileBlock failed: %s", err)
+						return
+					}
+					if !bytes.Equal(fb.Block, block) {
+						t.Errorf("WriteFileBlock changed the block")
+					}
+					offset += int64(len(block))
+				}
+			}()
+
+			// The buffer is reused for each block, as the server does.
+			var (
+				buf    bytes.Buffer
+				offset int64
+			)
+			for _, block := range blocks {
+				var fb FileBlockRequest
+				if err := ReadFileBlock(server, &fb, &buf, 0); err != nil {
+					t.Fatalf("ReadFileBlock failed: %s", err)
+				}
+
+				if !bytes.Equal(fb.Block, block) {
+					t.Fatalf("got block of %d bytes, want %d bytes", len(fb.Block), len(block))
+				}
+				if fb.Path != "/data.bin" || fb.UploadOffset != offset {
+					t.Fatalf("got path %q offset %d, want /data.bin offset %d", fb.Path, fb.UploadOffset, offset)
+				}
+				if fb.BinaryBlocks() != (test.version >= VersionBinaryBlocks) {
+					t.Fatalf("got BinaryBlocks %t for version %d", fb.BinaryBlocks(), test.version)
+				}
+				offset += int64(len(block))
+			}
+		})
+	}
+}
+
+func TestReadFileBlockTooLarge(t *testing.T) {
+	client, server := newConnPair(t)
+
+	go func() {
+		fb := FileBlockRequest{Block: make([]byte, 100), Version: NewVersion(VersionBinaryBlocks)}
+		_ = WriteFileBlock(client, &fb)
+	}()
+
+	var (
+		fb  FileBlockRequest
+		buf bytes.Buffer
+	)
+	if err := ReadFileBlock(server, &fb, &buf, 99); err != ErrBlockTooLarge {
+		t.Fatalf("ReadFileBlock = %v, want ErrBlockTooLarge", err)
+	}
+}
+
+func TestReadFileBlockBadBinaryBlock(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentLen  int64
+		messageType int
+		message     []byte
+		want        error
+	}{
+		{name: "short block", contentLen: 10, messageType: websocket.BinaryMessage, message: []byte("short"), want: ErrBlockLengthMismatch},
+		{name: "long block", contentLen: 2, messageType: websocket.BinaryMessage, message: []byte("longer"), want: ErrBlockLengthMismatch},
+		{name: "text message", contentLen: 4, messageType: websocket.TextMessage, message: []byte("text"), want: ErrExpectedBinaryBlock},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newConnPair(t)
+
+			go func() {
+				header := FileBlockRequest{ContentLength: test.contentLen, Version: NewVersion(VersionBinaryBlocks)}
+				if err := client.WriteJSON(header); err != nil {
+					t.Errorf("WriteJSON failed: %s", err)
+					return
+				}
+				_ = client.WriteMessage(test.messageType, test.message)
+			}()
+
+			var (
+				fb  FileBlockRequest
+				buf bytes.Buffer
+			)
+			if err := ReadFileBlock(server, &fb, &buf, 0); err != test.want {
+				t.Fatalf("ReadFileBlock = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package protocol
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 type RequestType int
 
@@ -15,6 +18,9 @@ const (
 	ServerInfoReq
 	UploadFileReq
 	ServerConnectRequestType
+	CreateSessionTokenReq
+	RevokeSessionTokenReq
+	OfferChecksumReq
 )
 
 var KnownRequestTypes = map[RequestType]bool{
@@ -28,19 +34,95 @@ var KnownRequestTypes = map[RequestType]bool{
 	ServerInfoReq:            true,
 	UploadFileReq:            true,
 	ServerConnectRequestType: true,
+	CreateSessionTokenReq:    true,
+	RevokeSessionTokenReq:    true,
+	OfferChecksumReq:         true,
 }
 
+// Protocol versions. Clients that predate versioning send an empty version, which is treated as
+// VersionJSONBlocks.
+const (
+	// VersionJSONBlocks sends file blocks inside the FileBlockRequest JSON (base64 encoded).
+	VersionJSONBlocks = 1
+
+	// VersionBinaryBlocks sends the FileBlockRequest JSON without the block as a header, followed by
+	// the block in a websocket binary message.
+	VersionBinaryBlocks = 2
+
+	// VersionAuthResponse answers an AuthenticateRequest with an AuthenticateResponse and a status. Older
+	// clients don't read anything after authenticating, so they aren't sent either.
+	VersionAuthResponse = 3
+
+	CurrentVersion = VersionAuthResponse
+)
+
 type Version struct {
 	Version string `json:"version"`
 }
 
+func NewVersion(version int) Version {
+	return Version{Version: strconv.Itoa(version)}
+}
+
+// Number returns the version as a number, treating a missing or unparseable version as VersionJSONBlocks.
+func (v Version) Number() int {
+	n, err := strconv.Atoi(v.Version)
+	if err != nil {
+		return VersionJSONBlocks
+	}
+
+	return n
+}
+
+// BinaryBlocks returns true if the version sends file blocks as binary messages.
+func (v Version) BinaryBlocks() bool {
+	return v.Number() >= VersionBinaryBlocks
+}
+
 type IncomingRequestType struct {
 	RequestType RequestType `json:"request_type"`
 }
 
+// AuthenticateRequest authenticates a session with either the user's API token, or a session token
+// created by a session that authenticated with the API token.
 type AuthenticateRequest struct {
-	APIToken  string `json:"apitoken"`
-	ProjectID int    `json:"project_id"`
+	APIToken     string `json:"apitoken"`
+	SessionToken string `json:"session_token"`
+	ProjectID    int    `json:"project_id"`
+	Version
+}
+
+// AuthenticateResponse is sent when the client has authenticated, and identifies the user the API token
+// belongs to and the project the session is for.
+type AuthenticateResponse struct {
+	UserID      int    `json:"user_id"`
+	UserName    string `json:"user_name"`
+	UserEmail   string `json:"user_email"`
+	ProjectID   int    `json:"project_id"`
+	ProjectName string `json:"project_name"`
+	Version
+}
+
+// CreateSessionTokenRequest asks for a session token that expires after ExpiresIn seconds. The server
+// limits how long a token can last, and uses that limit when ExpiresIn is 0. If PathPrefix is set then
+// sessions using the token can only upload under that path in the project.
+type CreateSessionTokenRequest struct {
+	ExpiresIn  int    `json:"expires_in"`
+	PathPrefix string `json:"path_prefix"`
+	Version
+}
+
+type SessionTokenResponse struct {
+	SessionToken string    `json:"session_token"`
+	PathPrefix   string    `json:"path_prefix"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Version
+}
+
+// RevokeSessionTokenRequest revokes a session token. An empty SessionToken revokes the token the
+// session authenticated with.
+type RevokeSessionTokenRequest struct {
+	SessionToken string `json:"session_token"`
 	Version
 }
 
@@ -68,6 +150,9 @@ type FinishUploadRequest struct {
 	Version
 }
 
+// FileInfo describes a file or directory. UploadComplete is false for an interrupted upload that hasn't
+// been finished, in which case Size is how much of the file the server has. Only complete files can be
+// downloaded.
 type FileInfo struct {
 	Name              string    `json:"name"`
 	IsDir             bool      `json:"is_dir"`
@@ -79,13 +164,39 @@ type FileInfo struct {
 	UpdatedAt         time.Time `json:"updated_at"`
 }
 
+type ListDirectoryRequest struct {
+	Path string `json:"path"`
+	Version
+}
+
+// ListDirectoryResponse lists the entries in a directory. Listing a file returns just that file, with
+// IsDir false.
 type ListDirectoryResponse struct {
 	Path   string     `json:"path"`
 	Status string     `json:"status"`
+	IsDir  bool       `json:"is_dir"`
 	Files  []FileInfo `json:"files"`
 	Version
 }
 
+// OfferChecksumRequest is sent before uploading a file, with the size and checksum of the whole file. If
+// the project already has a file with the same contents then the server creates the file at Path using
+// those contents, and the file doesn't need to be uploaded.
+type OfferChecksumRequest struct {
+	Path              string `json:"path"`
+	Size              int64  `json:"size"`
+	Checksum          string `json:"checksum"`
+	ChecksumAlgorithm string `json:"checksum_algorithm"`
+	Version
+}
+
+// OfferChecksumResponse tells the client whether the file was created from existing contents. If Uploaded
+// is false the client uploads the file as usual.
+type OfferChecksumResponse struct {
+	Uploaded bool `json:"uploaded"`
+	Version
+}
+
 type PauseUploadRequest struct {
 	Path string `json:"path"`
 	Version
@@ -102,24 +213,39 @@ type FileBlockRequest struct {
 	Version
 }
 
+type ServerInfoRequest struct {
+	Version
+}
+
+// ServerInfoResponse describes the limits and features of the server. MaxSize is the largest file the
+// server accepts (0 means no limit), and MaxBlockSize the largest block. UploadExpirationTime is the
+// number of seconds an interrupted upload is kept for resuming, 0 means uploads can't be resumed.
 type ServerInfoResponse struct {
 	MaxSize                 int64    `json:"max_size"`
+	MaxBlockSize            int64    `json:"max_block_size"`
 	ChecksumAlgorithms      []string `json:"checksum_algorithms"`
 	BlockChecksumsSupported bool     `json:"block_checksums_supported"`
 	UploadExpirationTime    int      `json:"upload_expiration_time"`
+	SessionTokensSupported  bool     `json:"session_tokens_supported"`
+	OfferChecksumSupported  bool     `json:"offer_checksum_supported"`
 	Version
 }
 
+// StatusResponse reports the outcome of a request. When IsError is true Status is a description of the
+// error and ErrorCode identifies it.
 type StatusResponse struct {
 	Path           string `json:"path"`
 	ForRequestType string `json:"for_request_type"`
 	Status         string `json:"status"`
 	IsError        bool
+	ErrorCode      ErrorCode `json:"error_code"`
 	Version
 }
 
 type UploadFileRequest struct {
-	Path string `json:"path"`
-	Size int64  `json:"size"`
+	Path              string `json:"path"`
+	Size              int64  `json:"size"`
+	UploadOffset      int64  `json:"upload_offset"`
+	ChecksumAlgorithm string `json:"checksum_algorithm"`
 	Version
 }